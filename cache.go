@@ -0,0 +1,175 @@
+package qcon
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Default lifetimes of Cache entries
+const (
+	DefaultCacheTTL    = 5 * time.Minute
+	DefaultNegativeTTL = 30 * time.Second
+)
+
+// Cache holds recent Resolutions by QuickConnect ID, for servers that
+// resolve the same devices repeatedly. Concurrent lookups of an ID that
+// is not cached share a single resolution. Expired entries are removed
+// as new ones are added, so the Cache only grows with the number of IDs
+// looked up within TTL.
+type Cache struct {
+	Client      *Client       // DefaultClient if nil
+	TTL         time.Duration // lifetime of successful results, DefaultCacheTTL if zero
+	NegativeTTL time.Duration // lifetime of failures, DefaultNegativeTTL if zero
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	sweepAt int // size at which expired entries are next removed
+}
+
+type cacheEntry struct {
+	res     *Resolution
+	err     error
+	expires time.Time
+	done    chan struct{} // closed once resolved
+}
+
+// NewCache returns a Cache resolving with c, or DefaultClient if nil.
+func NewCache(c *Client) *Cache {
+	return &Cache{Client: c}
+}
+
+// Resolve returns the Resolution of the given QuickConnect ID, from the
+// cache if present and not expired, along with how much longer the
+// result will be cached. Errors are cached too, except cancellation and
+// invalid IDs, which are not looked up.
+//
+// The resolution runs on a context of its own, bounded by the Client's
+// Timeout, as it may be shared by several lookups; ctx only limits how
+// long this lookup waits for it.
+func (c *Cache) Resolve(ctx context.Context, id string) (*Resolution, time.Duration, error) {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	id, err := ParseID(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.mu.Lock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+
+	e, ok := c.entries[id]
+
+	if ok && isDone(e) && !time.Now().Before(e.expires) {
+		ok = false
+	}
+
+	if !ok {
+		if len(c.entries) >= c.sweepAt {
+			c.sweep()
+		}
+
+		e = &cacheEntry{done: make(chan struct{})}
+		c.entries[id] = e
+
+		go c.resolve(id, e)
+	}
+
+	c.mu.Unlock()
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return nil, 0, ErrCancelled
+	}
+
+	return e.res, time.Until(e.expires), e.err
+}
+
+// resolve performs the lookup for entry e.
+func (c *Cache) resolve(id string, e *cacheEntry) {
+
+	client := c.Client
+	if client == nil {
+		client = DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), client.sharedTimeout())
+	defer cancel()
+
+	e.res, e.err = client.ResolveDetailed(ctx, id)
+
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+
+	if e.err != nil {
+		ttl = c.NegativeTTL
+		if ttl <= 0 {
+			ttl = DefaultNegativeTTL
+		}
+	}
+
+	e.expires = time.Now().Add(ttl)
+
+	if e.err == ErrCancelled {
+		c.mu.Lock()
+		if c.entries[id] == e {
+			delete(c.entries, id)
+		}
+		c.mu.Unlock()
+	}
+
+	close(e.done)
+}
+
+// Invalidate removes any cached result for the given QuickConnect ID,
+// so that it is resolved again on next use.
+func (c *Cache) Invalidate(id string) {
+
+	id, err := ParseID(id)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok && isDone(e) {
+		delete(c.entries, id)
+	}
+
+	c.sweep()
+}
+
+// sweep removes expired entries. The next sweep is due once the cache
+// has doubled in size, so the cost is spread over the entries added.
+// c.mu must be held.
+func (c *Cache) sweep() {
+
+	now := time.Now()
+
+	for id, e := range c.entries {
+		if isDone(e) && !now.Before(e.expires) {
+			delete(c.entries, id)
+		}
+	}
+
+	c.sweepAt = 2*len(c.entries) + 64
+}
+
+func isDone(e *cacheEntry) bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,179 @@
+package qcon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+
+	defer setZones()()
+
+	tr := &mockTransport{
+		responses: map[string]response{
+			defaultServURL:                        {Status: 200, Body: testServResp, Delay: 0.05},
+			"https://10.20.1.100:5001" + pingPath: {Status: 200, Body: testPingSuccess},
+		},
+	}
+
+	var queries int32
+
+	c := &Client{
+		Client: &http.Client{
+			Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.String() == defaultServURL {
+					body, _ := ioutil.ReadAll(req.Body)
+					if bytes.Contains(body, []byte(CmdGetServerInfo)) {
+						atomic.AddInt32(&queries, 1)
+					}
+					req.Body = ioutil.NopCloser(bytes.NewReader(body))
+				}
+				return tr.RoundTrip(req)
+			}),
+		},
+		Timeout: 100 * time.Millisecond,
+	}
+
+	cache := NewCache(c)
+	cache.TTL = time.Hour
+
+	// Concurrent lookups, in different forms of the ID, share one
+	// resolution
+	var wg sync.WaitGroup
+
+	for _, id := range []string{"foo", "FOO", "quickconnect.to/foo"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			res, ttl, err := cache.Resolve(context.Background(), id)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", id, err)
+				return
+			}
+
+			if res.Best.URL != "https://10.20.1.100:5001" || ttl <= 0 || ttl > time.Hour {
+				t.Errorf("%s: unexpected result %s, ttl %s", id, res.Best.URL, ttl)
+			}
+		}(id)
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("expected 1 get_server_info query, got %d", n)
+	}
+
+	cache.Invalidate("foo")
+
+	if _, _, err := cache.Resolve(context.Background(), "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("expected 2 get_server_info queries after invalidating, got %d", n)
+	}
+
+	// Failures are cached for NegativeTTL
+	delete(tr.responses, "https://10.20.1.100:5001"+pingPath)
+	cache.Invalidate("foo")
+	cache.NegativeTTL = 10 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := cache.Resolve(context.Background(), "foo"); err != ErrCannotAccess {
+			t.Fatalf("expected ErrCannotAccess, got %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&queries); n != 3 {
+		t.Errorf("expected failure to be cached, got %d queries", n)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	cache.Resolve(context.Background(), "foo")
+
+	if n := atomic.LoadInt32(&queries); n != 4 {
+		t.Errorf("expected failure to expire, got %d queries", n)
+	}
+
+	if _, _, err := cache.Resolve(context.Background(), "not valid!"); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID, got %v", err)
+	}
+}
+
+func TestCacheShared(t *testing.T) {
+
+	defer setZones()()
+
+	tr := &mockTransport{
+		responses: map[string]response{
+			defaultServURL:                        {Status: 200, Body: testServResp, Delay: 0.05},
+			"https://10.20.1.100:5001" + pingPath: {Status: 200, Body: testPingSuccess},
+		},
+	}
+
+	c := &Client{
+		Client:  &http.Client{Transport: tr},
+		Timeout: 100 * time.Millisecond,
+	}
+
+	cache := NewCache(c)
+
+	// Cancelling the lookup that started the resolution does not fail
+	// the others waiting on it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	errc := make(chan error, 1)
+
+	go func() {
+		_, _, err := cache.Resolve(ctx, "foo")
+		errc <- err
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+
+	res, _, err := cache.Resolve(context.Background(), "foo")
+	if err != nil || res.Best.URL != "https://10.20.1.100:5001" {
+		t.Fatalf("unexpected result %v: %v", res, err)
+	}
+
+	if err := <-errc; err != ErrCancelled {
+		t.Errorf("expected ErrCancelled for cancelled lookup, got %v", err)
+	}
+
+	// Expired entries are removed as others are added
+	delete(tr.responses, defaultServURL)
+	cache.NegativeTTL = time.Millisecond
+
+	for i := 0; i < 200; i++ {
+		cache.Resolve(context.Background(), fmt.Sprintf("dev%d", i))
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	cache.mu.Lock()
+	n := len(cache.entries)
+	cache.mu.Unlock()
+
+	if n > 100 {
+		t.Errorf("expected expired entries to be removed, have %d", n)
+	}
+
+	cache.Invalidate("foo")
+
+	cache.mu.Lock()
+	n = len(cache.entries)
+	cache.mu.Unlock()
+
+	if n != 0 {
+		t.Errorf("expected no entries after invalidating, have %d", n)
+	}
+}
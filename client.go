@@ -3,7 +3,10 @@ package qcon
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -22,10 +25,55 @@ const (
 // from any timeout settings inherited from http.Client and refers to
 // the time Resolve() and UpdateState() will wait for responses during
 // connectivity tests.
+//
+// If Resolver is set, GetInfo resolves FQDN and DDNS hostnames itself
+// and tests each returned address as a separate Record rather than
+// leaving the choice of address to net/http.
+//
+// By default UpdateState tests every Record at once. Setting Stagger
+// instead starts one test at a time in priority order, Stagger apart,
+// and stops testing lower priority Records once one succeeds. This
+// avoids a burst of connections at the cost of fewer verified Records.
+//
+// GetInfo fails with an *OfflineError when the QuickConnect server
+// reports the device is offline, saving the time spent testing its
+// Records. Set IgnoreOffline to test them anyway, for instance if the
+// server's view of the device may be out of date.
+//
+// Resolve only tests direct routes unless UseTunnel is set. With
+// UseTunnel, if no direct route answers, a relay tunnel is requested from
+// the QuickConnect server and its routes are tested in turn. This costs
+// a further control server request and round of pings, so resolving an
+// inaccessible device can take up to twice Timeout.
+//
+// Setting Pins enables trust-on-first-use certificate pinning for HTTPS
+// routes to IP addresses (see PinStore).
+//
+// A correct ping reply only shows that a host knows the device's public
+// server ID. With StrictTLS set, a Record is only marked StateOK if the
+// reply also came over TLS with a certificate that is valid for the
+// expected hostname or matches the pinned key. Otherwise it is marked
+// StateUntrustedTLS, as are all plain HTTP Records. The expected
+// hostname is Record.ServerName, the URL host if not an IP address, or
+// the ServerName in the transport's TLS config.
+//
+// If Policy is set, Records are only pinged at addresses it allows;
+// others are marked StateBlocked. The policy is checked when dialing, on
+// the addresses hostnames actually resolve to, so cannot be bypassed by
+// a DDNS name rebound to an internal address. With a RoundTripper other
+// than *http.Transport only IP address URLs can be checked. The
+// QuickConnect control server itself is not subject to the policy.
 type Client struct {
-	Client  *http.Client
-	Timeout time.Duration
-	servURL string // Not exported. Only override for testing
+	Client        *http.Client
+	Timeout       time.Duration
+	Resolver      HostResolver
+	Stagger       time.Duration
+	IgnoreOffline bool
+	UseTunnel     bool
+	Pins          PinStore
+	StrictTLS     bool
+	Policy        *AddrPolicy
+	servURL       string // Not exported. Only override for testing
 }
 
 // DefaultClient is the default Client used by Resolve.
@@ -34,8 +82,25 @@ var DefaultClient = &Client{}
 // GetInfo returns information for given QuickConnect ID retrieved
 // from the global QuickConnect server. This information includes
 // the set of all Records associated with this ID (see struct Info).
+// The ID may be given in any form accepted by ParseID.
+//
+// If the server reports the device offline, the error is an
+// *OfflineError (see Client.IgnoreOffline) and the returned Info is
+// complete except that hostnames are not expanded through Resolver.
 func (c Client) GetInfo(ctx context.Context, id string) (Info, error) {
 
+	id, err := ParseID(id)
+	if err != nil {
+		return Info{}, err
+	}
+
+	return c.getInfo(ctx, id, false)
+}
+
+// getInfo implements GetInfo for a validated ID, which is a gofile.me
+// share link ID if gofile is set.
+func (c Client) getInfo(ctx context.Context, id string, gofile bool) (Info, error) {
+
 	rs := Info{}
 
 	if ctx == nil {
@@ -47,18 +112,8 @@ func (c Client) GetInfo(ctx context.Context, id string) (Info, error) {
 
 	// TODO: Handle timeout
 
-	httpClient := c.Client
-	if httpClient == nil {
-		httpClient = &http.Client{}
-	}
-
-	servURL := c.servURL
-	if servURL == "" {
-		servURL = defaultServURL
-	}
-
 	// fetch info on servers
-	info, err := getServerInfo(ctx, httpClient, servURL, id)
+	info, err := c.getServerInfo(ctx, CmdGetServerInfo, id, gofile)
 	if err != nil {
 		return rs, err
 	}
@@ -67,32 +122,73 @@ func (c Client) GetInfo(ctx context.Context, id string) (Info, error) {
 		return rs, ErrParse
 	}
 
+	rs.ID = id
+	rs.gofile = gofile
 	rs.ServerID = info[0].Server.ServerID
+	rs.HTTPS = info[0]
+	rs.HTTP = info[1]
 
 	rs.Records = make([]Record, 0, 16)
 
-	for t := uint8(0); t < maxRecordType; t++ {
-		var i serverInfo
+	// checked first so an offline device costs no DNS lookups
+	offline := !c.IgnoreOffline && isOffline(rs.HTTPS)
 
-		if isHTTPS(t) {
-			i = info[0]
-		} else {
-			i = info[1]
-		}
+	rs.addRecords(interfaceZones())
 
-		for _, u := range getURLs(i, t) {
-			rs.add(Record{URL: u, Type: t})
-		}
+	if c.Resolver != nil && !offline {
+		c.expandHosts(ctx, &rs)
+	}
+
+	if offline {
+		return rs, &OfflineError{State: rs.HTTPS.Server.DSState, PingPong: rs.HTTPS.Service.PingPong}
 	}
 
 	return rs, nil
 }
 
+// RequestTunnel asks the QuickConnect server to set up a relay tunnel to
+// the device described by info, which must have been returned by
+// GetInfo. Records for the tunnel endpoints are added to info, with
+// the lowest priority of all Records. The HTTPS and HTTP responses in
+// info are replaced by the request_tunnel responses.
+func (c Client) RequestTunnel(ctx context.Context, info *Info) error {
+
+	if info.ID == "" {
+		return ErrInvalidID
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	resp, err := c.getServerInfo(ctx, CmdRequestTunnel, info.ID, info.gofile)
+	if err != nil {
+		return err
+	}
+
+	info.HTTPS = resp[0]
+	info.HTTP = resp[1]
+
+	for t := httpsTunDualStack; t < maxRecordType; t++ {
+		recs, _ := getRecords(info.serverInfo(t), t, nil)
+
+		for _, r := range recs {
+			info.add(r)
+		}
+	}
+
+	return nil
+}
+
 // UpdateState attempts to connect to each URL within Info.Records
 // and updates the state value for each. By default, it has a 2 second
 // timeout unless Client.Timeout is set to a non-zero value.
 func (c Client) UpdateState(ctx context.Context, info *Info) error {
 
+	if c.Stagger > 0 {
+		return c.updateStaggered(ctx, info)
+	}
+
 	var err error
 	var wg sync.WaitGroup
 	var timeout *time.Timer
@@ -123,28 +219,15 @@ func (c Client) UpdateState(ctx context.Context, info *Info) error {
 		go func(r Record) {
 			defer wg.Done()
 
-			hash, err := c.Ping(ctx, r.URL)
-			if err != nil {
-				// Need to ensure we simply return if cancelled rather than
-				// try to write to channel
-				if ctx.Err() != nil {
-					return
-				}
-				r.State = StateConnectFailed
-				ch <- r
-				return
-			}
+			r.State, r.Err = c.probe(ctx, info.ServerID, r)
 
-			// verify ID
-			if !verifyID(info.ServerID, hash) {
-				r.State = StateInvalidServer
-				ch <- r
-				return
+			// Need to ensure we simply return if cancelled rather than
+			// block writing to channel
+			select {
+			case ch <- r:
+			case <-ctx.Done():
 			}
 
-			r.State = StateOK
-			ch <- r
-
 		}(r)
 
 		// Handle cancellation or timeout
@@ -169,6 +252,7 @@ func (c Client) UpdateState(ctx context.Context, info *Info) error {
 			for i := range info.Records {
 				if r.URL == info.Records[i].URL {
 					info.Records[i].State = r.State
+					info.Records[i].Err = r.Err
 					break
 				}
 			}
@@ -190,21 +274,69 @@ func (c Client) UpdateState(ctx context.Context, info *Info) error {
 	return err
 }
 
-func checkExtPort(s serverInfo) bool {
+// isOffline reports whether s shows the device disconnected from the
+// QuickConnect servers. A missing state is not treated as offline.
+func isOffline(s ServerInfo) bool {
+	return s.Server.DSState != "" && s.Server.DSState != "CONNECTED"
+}
+
+func checkExtPort(s ServerInfo) bool {
 	return s.Service.ExtPort != 0 && s.Service.ExtPort != s.Service.Port
 }
 
-func getURLs(s serverInfo, typ uint8) []string {
+// externalIPv6 returns the server's external IPv6 address if it is
+// usable and not already one of the interface addresses, otherwise
+// an empty string.
+func externalIPv6(s ServerInfo) string {
+
+	ip := net.ParseIP(s.Server.External.IPv6)
+	if ip == nil || ip.To4() != nil || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+		return ""
+	}
+
+	for _, ifc := range s.Server.Interface {
+		for _, a := range ifc.IPv6 {
+			if ip.Equal(net.ParseIP(a.Address)) {
+				return ""
+			}
+		}
+	}
+
+	return ip.String()
+}
+
+// zoneURL returns a URL for an IPv6 link-local address scoped to the
+// given local interface. The zone separator is percent-encoded as
+// required by RFC 6874.
+func zoneURL(proto, addr, zone string, port int) string {
+	u := url.URL{
+		Scheme: proto,
+		Host:   net.JoinHostPort(addr+"%"+zone, strconv.Itoa(port)),
+	}
+
+	return u.String()
+}
 
-	var urls []string
+// getRecords returns the candidate Records of the given type found in s,
+// each tagged with the response field it came from. Link-local IPv6
+// addresses are expanded into one Record per zone; if zones is empty they
+// cannot be dialed and are returned as skipped instead.
+func getRecords(s ServerInfo, typ uint8, zones []string) ([]Record, []Skipped) {
+
+	var recs []Record
+	var skipped []Skipped
 	var proto string
 
-	if typ < httpLanIPv4 || typ == httpsTun {
+	if isHTTPS(typ) {
 		proto = "https"
 	} else {
 		proto = "http"
 	}
 
+	add := func(u string, src Source) {
+		recs = append(recs, Record{URL: u, Type: typ, Sources: src})
+	}
+
 	switch typ {
 	// case httpsSmartLanIPv4:
 	// case httpsSmartLanIPv6:
@@ -217,7 +349,7 @@ func getURLs(s serverInfo, typ uint8) []string {
 			}
 
 			if isLocalIP(ifc.IP) {
-				urls = append(urls, fmt.Sprintf("%s://%s:%d", proto, ifc.IP, s.Service.Port))
+				add(fmt.Sprintf("%s://%s:%d", proto, ifc.IP, s.Service.Port), SourceInterface)
 			}
 		}
 
@@ -229,15 +361,15 @@ func getURLs(s serverInfo, typ uint8) []string {
 			}
 
 			if !isLocalIP(ifc.IP) {
-				urls = append(urls, fmt.Sprintf("%s://%s:%d", proto, ifc.IP, s.Service.Port))
+				add(fmt.Sprintf("%s://%s:%d", proto, ifc.IP, s.Service.Port), SourceInterface)
 			}
 		}
 
 		if s.Server.External.IP != "" && s.Server.External.IP != "NULL" && !isLocalIP(s.Server.External.IP) {
-			urls = append(urls, fmt.Sprintf("%s://%s:%d", proto, s.Server.External.IP, s.Service.Port))
+			add(fmt.Sprintf("%s://%s:%d", proto, s.Server.External.IP, s.Service.Port), SourceExternal)
 
 			if checkExtPort(s) {
-				urls = append(urls, fmt.Sprintf("%s://%s:%d", proto, s.Server.External.IP, s.Service.ExtPort))
+				add(fmt.Sprintf("%s://%s:%d", proto, s.Server.External.IP, s.Service.ExtPort), SourceExternal)
 			}
 		}
 
@@ -248,8 +380,17 @@ func getURLs(s serverInfo, typ uint8) []string {
 			}
 
 			for _, ip := range ifc.IPv6 {
-				if ip.Scope == "link" {
-					urls = append(urls, fmt.Sprintf("%s://[%s]:%d", proto, ip.Address, s.Service.Port))
+				if ip.Scope != "link" {
+					continue
+				}
+
+				if len(zones) == 0 {
+					skipped = append(skipped, Skipped{Address: ip.Address, Type: typ, Reason: ErrNoZone})
+					continue
+				}
+
+				for _, z := range zones {
+					add(zoneURL(proto, ip.Address, z, s.Service.Port), SourceInterface)
 				}
 			}
 		}
@@ -262,53 +403,77 @@ func getURLs(s serverInfo, typ uint8) []string {
 
 			for _, ip := range ifc.IPv6 {
 				if ip.Scope != "link" {
-					urls = append(urls, fmt.Sprintf("%s://[%s]:%d", proto, ip.Address, s.Service.Port))
+					add(fmt.Sprintf("%s://[%s]:%d", proto, ip.Address, s.Service.Port), SourceInterface)
 					if checkExtPort(s) {
-						urls = append(urls, fmt.Sprintf("%s://[%s]:%d", proto, ip.Address, s.Service.ExtPort))
+						add(fmt.Sprintf("%s://[%s]:%d", proto, ip.Address, s.Service.ExtPort), SourceInterface)
 					}
 				}
 			}
 		}
 
+		// External IPv6 is often a router-delegated address not bound to
+		// any interface, so only add it if it is not already listed.
+		if ext := externalIPv6(s); ext != "" {
+			add(fmt.Sprintf("%s://[%s]:%d", proto, ext, s.Service.Port), SourceExternal)
+			if checkExtPort(s) {
+				add(fmt.Sprintf("%s://[%s]:%d", proto, ext, s.Service.ExtPort), SourceExternal)
+			}
+		}
+
 	case httpsFQDN, httpFQDN:
 		if s.Server.FQDN == "" || s.Server.FQDN == "NULL" {
 			break
 		}
 
+		add(fmt.Sprintf("%s://%s:%d", proto, s.Server.FQDN, s.Service.Port), SourceFQDN)
+
 		if checkExtPort(s) {
-			urls = make([]string, 2)
-			urls[1] = fmt.Sprintf("%s://%s:%d", proto, s.Server.FQDN, s.Service.ExtPort)
-		} else {
-			urls = make([]string, 1)
+			add(fmt.Sprintf("%s://%s:%d", proto, s.Server.FQDN, s.Service.ExtPort), SourceFQDN)
 		}
 
-		urls[0] = fmt.Sprintf("%s://%s:%d", proto, s.Server.FQDN, s.Service.Port)
-
 	case httpsDDNS, httpDDNS:
 		if s.Server.DDNS == "" || s.Server.DDNS == "NULL" {
 			break
 		}
 
+		add(fmt.Sprintf("%s://%s:%d", proto, s.Server.DDNS, s.Service.Port), SourceDDNS)
+
 		if checkExtPort(s) {
-			urls = make([]string, 2)
-			urls[1] = fmt.Sprintf("%s://%s:%d", proto, s.Server.DDNS, s.Service.ExtPort)
-		} else {
-			urls = make([]string, 1)
+			add(fmt.Sprintf("%s://%s:%d", proto, s.Server.DDNS, s.Service.ExtPort), SourceDDNS)
+		}
+
+	case httpsTunDualStack:
+		if h := s.Service.RelayDualStack; h != "" && h != "NULL" && s.Service.RelayPort != 0 {
+			add(fmt.Sprintf("%s://%s:%d", proto, h, s.Service.RelayPort), SourceRelay)
+		}
+
+	case httpsTunDN:
+		if h := s.Service.RelayDN; h != "" && h != "NULL" && s.Service.RelayPort != 0 {
+			add(fmt.Sprintf("%s://%s:%d", proto, h, s.Service.RelayPort), SourceRelay)
+		}
+
+	case httpsTun, httpTun:
+		if s.Service.RelayPort == 0 {
+			break
 		}
 
-		urls[0] = fmt.Sprintf("%s://%s:%d", proto, s.Server.DDNS, s.Service.Port)
+		if ip := s.Service.RelayIP; ip != "" && ip != "NULL" {
+			add(fmt.Sprintf("%s://%s:%d", proto, ip, s.Service.RelayPort), SourceRelay)
+		}
+
+		if ip := net.ParseIP(s.Service.RelayIPv6); ip != nil && !ip.IsUnspecified() {
+			add(fmt.Sprintf("%s://[%s]:%d", proto, ip, s.Service.RelayPort), SourceRelay)
+		}
+
+	case httpsTunHTTPS:
+		if ip := s.Service.HTTPSIP; ip != "" && ip != "NULL" && s.Service.HTTPSPort != 0 {
+			add(fmt.Sprintf("%s://%s:%d", proto, ip, s.Service.HTTPSPort), SourceRelay)
+		}
 
 		// case httpsSmartHost:
 		// case httpsSmartWanIPv6:
 		// case httpsSmartWanIPv4:
-		// case httpsWanIPv6:
-		// case httpsWanIPv4:
-		// case httpLanIPv6:
-		// case httpWanIPv6:
-		// case httpWanIPv4:
-		// case httpsTun:
-		// case httpTun:
 	}
 
-	return urls
+	return recs, skipped
 }
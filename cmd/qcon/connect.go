@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"jbowen.dev/qcon"
+)
+
+// connectTimeout bounds each TCP connection attempt.
+const connectTimeout = 10 * time.Second
+
+// runConnect resolves a device and copies stdin and stdout to a TCP
+// connection to the given port on its best direct route, for use as an
+// ssh ProxyCommand:
+//
+//	Host *.quickconnect.to
+//		ProxyCommand qcon connect %h %p
+func runConnect(ctx context.Context, c *cli, args []string) error {
+
+	fs := c.flagSet("connect")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+
+	port, err := strconv.Atoi(fs.Arg(1))
+	if err != nil || port <= 0 || port > 65535 {
+		return errUsage
+	}
+
+	client := c.qcon()
+
+	hosts, err := client.ResolveHosts(ctx, fs.Arg(0), 0)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialHosts(ctx, client, hosts, port)
+	if err != nil {
+		return err
+	}
+
+	return pipe(conn, c.stdin, c.stdout)
+}
+
+// dialHosts connects to port on the first of hosts that accepts the
+// connection, skipping tunnel routes.
+func dialHosts(ctx context.Context, client *qcon.Client, hosts []qcon.Host, port int) (net.Conn, error) {
+
+	err := qcon.ErrTunnel
+
+	for _, h := range hosts {
+		addr, aerr := h.Addr(port)
+		if aerr != nil {
+			continue
+		}
+
+		dctx, cancel := context.WithTimeout(ctx, connectTimeout)
+		conn, derr := client.DialContext(dctx, "tcp", addr)
+		cancel()
+
+		if derr == nil {
+			return conn, nil
+		}
+
+		err = derr
+	}
+
+	if err == qcon.ErrTunnel {
+		return nil, fmt.Errorf("no direct route to device: %s", err)
+	}
+
+	return nil, err
+}
+
+// pipe copies in to conn and conn to out until conn is closed by the
+// remote end. The write side of conn is closed when in reaches EOF.
+func pipe(conn net.Conn, in io.Reader, out io.Writer) error {
+
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, in)
+
+		if tc, ok := conn.(interface{ CloseWrite() error }); ok {
+			tc.CloseWrite()
+		}
+	}()
+
+	_, err := io.Copy(out, conn)
+
+	return err
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"jbowen.dev/qcon"
+)
+
+// runDNS answers DNS queries for <id>.<domain> with the address of the
+// best direct route to the device until interrupted.
+func runDNS(ctx context.Context, c *cli, args []string) error {
+
+	fs := c.flagSet("dns")
+	listen := fs.String("listen", "127.0.0.1:5353", "UDP `address` to listen on")
+	domain := fs.String("domain", "qcon.internal", "`domain` under which device names are answered")
+	ttl := fs.Duration("ttl", qcon.DefaultCacheTTL, "how long resolutions are cached")
+
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		return err
+	}
+
+	cache := qcon.NewCache(c.qcon())
+	cache.TTL = *ttl
+
+	d := &dnsServer{cache: cache, domain: *domain}
+
+	fmt.Fprintf(c.stderr, "qcon: answering for *.%s on %s\n", d.zone(), conn.LocalAddr())
+
+	return d.serve(ctx, conn)
+}
+
+// dnsServer is a minimal authoritative DNS server for device names.
+// Only A and AAAA records exist, along with the SOA record of the zone
+// that is returned with negative answers so they can be cached. Names
+// of devices that cannot be resolved, or are only reachable through a
+// tunnel, do not exist.
+type dnsServer struct {
+	cache  *qcon.Cache
+	domain string
+}
+
+// DNS protocol constants
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+
+	dnsHeaderLen = 12
+	dnsMaxUDP    = 512
+)
+
+// maxDNSQueries is the most queries handled at once. Further queries
+// are answered with SERVFAIL rather than starting more resolutions.
+const maxDNSQueries = 64
+
+// dnsQuery is a decoded DNS query.
+type dnsQuery struct {
+	id       uint16
+	flags    uint16
+	name     string // lower case, without trailing dot
+	qtype    uint16
+	qclass   uint16
+	question []byte // encoded question section, echoed in the reply
+}
+
+var errMalformed = errors.New("malformed DNS message")
+
+// zone returns the domain without leading or trailing dots.
+func (d *dnsServer) zone() string {
+	return strings.ToLower(strings.Trim(d.domain, "."))
+}
+
+// serve answers queries received on conn until ctx is cancelled.
+func (d *dnsServer) serve(ctx context.Context, conn net.PacketConn) error {
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 4096)
+	sem := make(chan struct{}, maxDNSQueries)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		msg := append([]byte(nil), buf[:n]...)
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			if q, err := parseQuery(msg); err == nil {
+				conn.WriteTo(dnsReply(q, dnsRcodeServFail, nil, 0), addr)
+			}
+			continue
+		}
+
+		go func() {
+			defer func() { <-sem }()
+
+			if reply := d.handle(ctx, msg); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// handle returns the reply to the DNS message msg, or nil if no reply
+// should be sent.
+func (d *dnsServer) handle(ctx context.Context, msg []byte) []byte {
+
+	q, err := parseQuery(msg)
+	if err != nil {
+		if len(msg) < dnsHeaderLen || msg[2]&0x80 != 0 {
+			// not a query we can reply to
+			return nil
+		}
+		return dnsReply(&dnsQuery{id: binary.BigEndian.Uint16(msg), flags: binary.BigEndian.Uint16(msg[2:])}, dnsRcodeFormErr, nil, 0)
+	}
+
+	if opcode := (q.flags >> 11) & 0xf; opcode != 0 {
+		return dnsReply(q, dnsRcodeNotImp, nil, 0)
+	}
+
+	zone := d.zone()
+
+	if q.qclass != dnsClassIN || q.name != zone && !strings.HasSuffix(q.name, "."+zone) {
+		return dnsReply(q, dnsRcodeRefused, nil, 0)
+	}
+
+	if q.name == zone {
+		// the apex has only the SOA record
+		return withSOA(dnsReply(q, 0, nil, 0), q, zone, qcon.DefaultNegativeTTL, q.qtype == dnsTypeSOA)
+	}
+
+	id := strings.TrimSuffix(q.name, "."+zone)
+	if strings.Contains(id, ".") {
+		return withSOA(dnsReply(q, dnsRcodeNXDomain, nil, 0), q, zone, qcon.DefaultNegativeTTL, false)
+	}
+
+	res, ttl, err := d.cache.Resolve(ctx, id)
+	if err != nil {
+		var ue *url.Error
+		var ne net.Error
+		if errors.As(err, &ue) || errors.As(err, &ne) || err == qcon.ErrCancelled {
+			return dnsReply(q, dnsRcodeServFail, nil, 0)
+		}
+		return withSOA(dnsReply(q, dnsRcodeNXDomain, nil, 0), q, zone, ttl, false)
+	}
+
+	ips := directIPs(res)
+	if len(ips) == 0 {
+		return withSOA(dnsReply(q, dnsRcodeNXDomain, nil, 0), q, zone, ttl, false)
+	}
+
+	var answer net.IP
+
+	for _, ip := range ips {
+		if (q.qtype == dnsTypeA) == (ip.To4() != nil) && (q.qtype == dnsTypeA || q.qtype == dnsTypeAAAA) {
+			answer = ip
+			break
+		}
+	}
+
+	if answer == nil {
+		// the name exists, but has no record of this type
+		return withSOA(dnsReply(q, 0, nil, 0), q, zone, ttl, false)
+	}
+
+	return dnsReply(q, 0, answer, ttl)
+}
+
+// directIPs returns the IP addresses of the verified direct routes of
+// res in ranked order. Link-local addresses are omitted, as they cannot
+// be used without a zone.
+func directIPs(res *qcon.Resolution) []net.IP {
+
+	var ips []net.IP
+
+	for _, h := range res.Hosts() {
+		if h.Class == qcon.RouteTunnel {
+			continue
+		}
+
+		ip := net.ParseIP(h.Host)
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips
+}
+
+// parseQuery decodes a DNS query with a single question.
+func parseQuery(msg []byte) (*dnsQuery, error) {
+
+	if len(msg) < dnsHeaderLen {
+		return nil, errMalformed
+	}
+
+	q := &dnsQuery{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+
+	if q.flags&0x8000 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, errMalformed
+	}
+
+	var labels []string
+
+	off := dnsHeaderLen
+
+	for {
+		if off >= len(msg) {
+			return nil, errMalformed
+		}
+
+		n := int(msg[off])
+		off++
+
+		if n == 0 {
+			break
+		}
+
+		// compression is not expected in a question and labels
+		// are at most 63 bytes
+		if n > 63 || off+n > len(msg) {
+			return nil, errMalformed
+		}
+
+		labels = append(labels, strings.ToLower(string(msg[off:off+n])))
+		off += n
+	}
+
+	if off+4 > len(msg) {
+		return nil, errMalformed
+	}
+
+	q.name = strings.Join(labels, ".")
+	q.qtype = binary.BigEndian.Uint16(msg[off:])
+	q.qclass = binary.BigEndian.Uint16(msg[off+2:])
+	q.question = msg[dnsHeaderLen : off+4]
+
+	return q, nil
+}
+
+// dnsReply encodes the reply to q with the given response code and, if
+// ip is not nil, a single A or AAAA answer with the given TTL. The
+// answer name refers to the question name by compression pointer.
+func dnsReply(q *dnsQuery, rcode int, ip net.IP, ttl time.Duration) []byte {
+
+	// QR, AA, and RD copied from the query
+	flags := 0x8000 | 0x0400 | (q.flags & 0x0100) | uint16(rcode)
+
+	msg := make([]byte, dnsHeaderLen, dnsMaxUDP)
+
+	binary.BigEndian.PutUint16(msg[0:], q.id)
+	binary.BigEndian.PutUint16(msg[2:], flags)
+
+	if q.question != nil {
+		binary.BigEndian.PutUint16(msg[4:], 1)
+		msg = append(msg, q.question...)
+	}
+
+	if ip == nil {
+		return msg
+	}
+
+	typ, data := uint16(dnsTypeA), ip.To4()
+	if data == nil {
+		typ, data = dnsTypeAAAA, ip.To16()
+	}
+
+	secs := math.Ceil(ttl.Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+
+	binary.BigEndian.PutUint16(msg[6:], 1)
+
+	var rr [12]byte
+
+	binary.BigEndian.PutUint16(rr[0:], 0xc000|dnsHeaderLen)
+	binary.BigEndian.PutUint16(rr[2:], typ)
+	binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+	binary.BigEndian.PutUint32(rr[6:], uint32(secs))
+	binary.BigEndian.PutUint16(rr[10:], uint16(len(data)))
+
+	msg = append(msg, rr[:]...)
+
+	return append(msg, data...)
+}
+
+// withSOA appends the SOA record of zone to msg, the reply to q, in the
+// answer section if answer is set and otherwise in the authority
+// section, where it allows the negative reply to be cached for ttl. The
+// record names refer to the zone within the question by compression
+// pointer, so q.name must be zone or a name within it.
+func withSOA(msg []byte, q *dnsQuery, zone string, ttl time.Duration, answer bool) []byte {
+
+	secs := math.Ceil(ttl.Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+
+	// offset of the zone's labels in the question name
+	ptr := 0xc000 | uint16(dnsHeaderLen+len(q.name)-len(zone))
+
+	var rr []byte
+
+	rr = appendUint16(rr, ptr)
+	rr = appendUint16(rr, dnsTypeSOA)
+	rr = appendUint16(rr, dnsClassIN)
+	rr = appendUint32(rr, uint32(secs))
+
+	var data []byte
+
+	data = appendUint16(data, ptr) // MNAME: the zone itself
+	data = append(data, 10)
+	data = append(data, "hostmaster"...)
+	data = appendUint16(data, ptr) // RNAME: hostmaster@zone
+
+	data = appendUint32(data, 1)            // serial
+	data = appendUint32(data, 3600)         // refresh
+	data = appendUint32(data, 600)          // retry
+	data = appendUint32(data, 86400)        // expire
+	data = appendUint32(data, uint32(secs)) // negative caching TTL
+
+	rr = appendUint16(rr, uint16(len(data)))
+	rr = append(rr, data...)
+
+	count := 8 // NSCOUNT
+	if answer {
+		count = 6 // ANCOUNT
+	}
+
+	binary.BigEndian.PutUint16(msg[count:], binary.BigEndian.Uint16(msg[count:])+1)
+
+	return append(msg, rr...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
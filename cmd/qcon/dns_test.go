@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"jbowen.dev/qcon"
+	"jbowen.dev/qcon/qcontest"
+)
+
+// dnsQueryMsg encodes a recursive query for name and qtype.
+func dnsQueryMsg(id uint16, name string, qtype uint16) []byte {
+
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, l := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(l)))
+		msg = append(msg, l...)
+	}
+
+	return append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+func TestDNS(t *testing.T) {
+
+	srv := newTestDevice()
+	defer srv.Close()
+
+	srv.Add(qcontest.Device{
+		ID:         "tunnelonly",
+		ServerID:   "876543210",
+		Interfaces: []qcontest.Interface{{Name: "eth0", IP: "10.0.0.5"}},
+		Relay:      &qcontest.Relay{DN: "usr1.example.quickconnect.to", Port: 2905},
+		Endpoints: map[string]qcontest.Endpoint{
+			"https://usr1.example.quickconnect.to:2905": {},
+		},
+	})
+
+	client := srv.Client()
+	client.Timeout = 200 * time.Millisecond
+
+	cache := qcon.NewCache(client)
+	cache.TTL = time.Minute
+
+	d := &dnsServer{cache: cache, domain: "qcon.internal."}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go d.serve(ctx, pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Negative answers carry the SOA record of the zone in the
+	// authority section, as does the answer to an SOA query at the apex
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+		soa    bool
+	}{
+		{"mynas.qcon.internal", dnsTypeA, 0, "127.0.0.1", false},
+		{"MyNAS.QCon.Internal", dnsTypeA, 0, "127.0.0.1", false},
+		{"mynas.qcon.internal", dnsTypeAAAA, 0, "", true},
+		{"tunnelonly.qcon.internal", dnsTypeA, dnsRcodeNXDomain, "", true},
+		{"nobody.qcon.internal", dnsTypeA, dnsRcodeNXDomain, "", true},
+		{"www.mynas.qcon.internal", dnsTypeA, dnsRcodeNXDomain, "", true},
+		{"qcon.internal", dnsTypeA, 0, "", true},
+		{"qcon.internal", dnsTypeSOA, 0, "SOA", false},
+		{"mynas.example.com", dnsTypeA, dnsRcodeRefused, "", false},
+	}
+
+	for i, tc := range tests {
+		id := uint16(0x1000 + i)
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := conn.Write(dnsQueryMsg(id, tc.name, tc.qtype)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, dnsMaxUDP)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		reply := buf[:n]
+
+		if binary.BigEndian.Uint16(reply) != id {
+			t.Errorf("%s: reply ID mismatch", tc.name)
+		}
+
+		flags := binary.BigEndian.Uint16(reply[2:])
+		if flags&0x8000 == 0 || flags&0x0100 == 0 || int(flags&0xf) != tc.rcode {
+			t.Errorf("%s: unexpected flags %04x", tc.name, flags)
+		}
+
+		ancount := binary.BigEndian.Uint16(reply[6:])
+		nscount := binary.BigEndian.Uint16(reply[8:])
+
+		q, _ := parseQuery(dnsQueryMsg(id, tc.name, tc.qtype))
+		rr := reply[dnsHeaderLen+len(q.question):]
+
+		// the SOA owner is the zone, by pointer into the question
+		isSOA := len(rr) > 4 && binary.BigEndian.Uint16(rr) == 0xc000|uint16(dnsHeaderLen+len(tc.name)-len("qcon.internal")) &&
+			binary.BigEndian.Uint16(rr[2:]) == dnsTypeSOA
+
+		if tc.soa != (nscount == 1 && isSOA) || !tc.soa && nscount != 0 {
+			t.Errorf("%s: unexpected authority section (%d records)", tc.name, nscount)
+		}
+
+		if tc.answer == "SOA" {
+			if ancount != 1 || !isSOA {
+				t.Errorf("%s: expected SOA answer", tc.name)
+			}
+			continue
+		}
+
+		if tc.answer == "" {
+			if ancount != 0 {
+				t.Errorf("%s: unexpected answer", tc.name)
+			}
+			continue
+		}
+
+		if ancount != 1 || len(rr) != 16 {
+			t.Fatalf("%s: expected one A record, got %d answers (%d bytes)", tc.name, ancount, len(rr))
+		}
+
+		ttl := binary.BigEndian.Uint32(rr[6:])
+		if ttl == 0 || ttl > 60 {
+			t.Errorf("%s: unexpected TTL %d", tc.name, ttl)
+		}
+
+		if ip := net.IP(rr[12:16]); ip.String() != tc.answer {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.answer, ip)
+		}
+	}
+
+	// Malformed queries get FORMERR
+	bad := dnsQueryMsg(0x2000, "mynas.qcon.internal", dnsTypeA)
+	if reply := d.handle(ctx, bad[:20]); reply == nil || reply[3]&0xf != dnsRcodeFormErr {
+		t.Errorf("expected FORMERR for truncated query, got %v", reply)
+	}
+}
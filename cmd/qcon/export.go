@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"jbowen.dev/qcon"
+)
+
+// runExport resolves a device and prints the mapping of its hostnames to
+// the best verified IP address as hosts file lines, curl --resolve
+// options or JSON, or writes them to a managed block of a hosts file.
+// If there is nothing to map, errNoMappings is returned whatever the
+// format, and the hosts file is left unchanged; the block is only
+// removed with -remove.
+func runExport(ctx context.Context, c *cli, args []string) error {
+
+	fs := c.flagSet("export")
+	format := fs.String("format", "hosts", "output `format`: hosts, curl or json")
+	hostsFile := fs.String("hosts-file", "", "update the qcon block for the device in this hosts `file` instead of printing")
+	remove := fs.Bool("remove", false, "remove the qcon block for the device from the -hosts-file")
+
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	switch *format {
+	case "hosts", "curl", "json":
+	default:
+		return errUsage
+	}
+
+	if *remove {
+		if *hostsFile == "" {
+			return errUsage
+		}
+
+		return qcon.UpdateHostsFile(*hostsFile, fs.Arg(0), nil)
+	}
+
+	res, err := c.qcon().ResolveDetailed(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	maps := qcon.Mappings(&res.Info)
+
+	if *hostsFile != "" {
+		if len(maps) == 0 {
+			return errNoMappings
+		}
+
+		return qcon.UpdateHostsFile(*hostsFile, fs.Arg(0), qcon.HostsLines(&res.Info))
+	}
+
+	switch *format {
+	case "hosts":
+		for _, l := range qcon.HostsLines(&res.Info) {
+			fmt.Fprintln(c.stdout, l)
+		}
+
+	case "curl":
+		var opts []string
+		for _, v := range qcon.CurlResolve(&res.Info) {
+			opts = append(opts, "--resolve "+v)
+		}
+		fmt.Fprintln(c.stdout, strings.Join(opts, " "))
+
+	case "json":
+		out := struct {
+			ID       string         `json:"id"`
+			ServerID string         `json:"server_id"`
+			URLs     []string       `json:"urls"`
+			Mappings []qcon.Mapping `json:"mappings"`
+		}{res.Info.ID, res.Info.ServerID, res.URLs(), maps}
+
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+	}
+
+	if len(maps) == 0 {
+		return errNoMappings
+	}
+
+	return nil
+}
+
+var errNoMappings = errors.New("no device hostname or verified IP address route to map it to")
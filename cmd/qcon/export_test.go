@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jbowen.dev/qcon/qcontest"
+)
+
+func TestExport(t *testing.T) {
+
+	srv := qcontest.NewServer(qcontest.Device{
+		ID:         "mynas",
+		ServerID:   "012345678",
+		FQDN:       "nas.example.com",
+		Interfaces: []qcontest.Interface{{Name: "eth0", IP: "10.0.0.5"}},
+		Endpoints: map[string]qcontest.Endpoint{
+			"http://10.0.0.5:5000": {},
+		},
+	})
+	defer srv.Close()
+
+	client := srv.Client()
+	client.Timeout = 200 * time.Millisecond
+
+	run := func(args ...string) string {
+		t.Helper()
+
+		var out, errOut bytes.Buffer
+
+		c := &cli{stdout: &out, stderr: &errOut, client: client}
+
+		if s := c.run(append([]string{"export"}, args...)); s != 0 {
+			t.Fatalf("%v: exit status %d: %s", args, s, errOut.String())
+		}
+
+		return out.String()
+	}
+
+	if out := run("mynas"); out != "10.0.0.5\tnas.example.com\n" {
+		t.Errorf("unexpected hosts output %q", out)
+	}
+
+	if out := run("-format", "curl", "mynas"); out != "--resolve nas.example.com:5000:10.0.0.5\n" {
+		t.Errorf("unexpected curl output %q", out)
+	}
+
+	var res struct {
+		ServerID string `json:"server_id"`
+		URLs     []string
+		Mappings []struct {
+			Name string
+			IP   string
+			Port int
+		}
+	}
+
+	if err := json.Unmarshal([]byte(run("-format", "json", "mynas")), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.ServerID != "012345678" || len(res.URLs) != 1 || len(res.Mappings) != 1 || res.Mappings[0].Port != 5000 {
+		t.Errorf("unexpected JSON output %+v", res)
+	}
+
+	dir, err := ioutil.TempDir("", "qcon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path, []byte("127.0.0.1\tlocalhost\n"), 0644)
+
+	run("-hosts-file", path, "mynas")
+
+	block := "127.0.0.1\tlocalhost\n# BEGIN qcon mynas\n10.0.0.5\tnas.example.com\n# END qcon mynas\n"
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != block {
+		t.Errorf("unexpected hosts file:\n%s", b)
+	}
+
+	// With nothing to map, every format fails and the block is kept
+	srv.Add(qcontest.Device{
+		ID:         "mynas",
+		ServerID:   "012345678",
+		Interfaces: []qcontest.Interface{{Name: "eth0", IP: "10.0.0.5"}},
+		Endpoints: map[string]qcontest.Endpoint{
+			"http://10.0.0.5:5000": {},
+		},
+	})
+
+	for _, args := range [][]string{{"mynas"}, {"-format", "json", "mynas"}, {"-hosts-file", path, "mynas"}} {
+		var out, errOut bytes.Buffer
+
+		c := &cli{stdout: &out, stderr: &errOut, client: client}
+
+		if s := c.run(append([]string{"export"}, args...)); s == 0 || !strings.Contains(errOut.String(), errNoMappings.Error()) {
+			t.Errorf("%v: expected failure with no mappings, got exit status %d: %s", args, s, errOut.String())
+		}
+	}
+
+	b, _ = ioutil.ReadFile(path)
+	if string(b) != block {
+		t.Errorf("hosts file changed with no mappings:\n%s", b)
+	}
+
+	run("-hosts-file", path, "-remove", "mynas")
+
+	b, _ = ioutil.ReadFile(path)
+	if string(b) != "127.0.0.1\tlocalhost\n" {
+		t.Errorf("block not removed:\n%s", b)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Command qcon resolves Synology QuickConnect IDs and provides tools for
+connecting to devices through the routes found.
+
+Usage:
+
+	qcon <command> [flags] [arguments]
+
+Run "qcon help" for the list of commands.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"jbowen.dev/qcon"
+)
+
+// command is a qcon subcommand.
+type command struct {
+	name    string
+	args    string // synopsis of arguments after the flags
+	summary string
+	run     func(ctx context.Context, c *cli, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"connect", "<id> <port>", "connect stdin and stdout to a TCP port on the device (for ssh ProxyCommand)", runConnect},
+		{"proxy", "<id>", "serve a local reverse proxy to the device's DSM web interface", runProxy},
+		{"dns", "", "answer DNS queries for <id>.qcon.internal with device addresses", runDNS},
+		{"export", "<id>", "print hosts file lines or curl --resolve options for the device", runExport},
+		{"serve", "", "serve resolutions over HTTP for other programs", runServe},
+	}
+}
+
+// cli holds the state shared by subcommands.
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// client overrides the qcon.Client built from the common flags
+	client *qcon.Client
+
+	timeout    time.Duration
+	dns        string
+	publicOnly bool
+	strictTLS  bool
+	tunnel     bool
+}
+
+// errUsage is returned by commands given invalid arguments.
+var errUsage = errors.New("invalid arguments")
+
+// errFlags is returned by commands given invalid flags, which have
+// already been reported by the flag package.
+var errFlags = errors.New("invalid flags")
+
+func main() {
+
+	c := &cli{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+
+	os.Exit(c.run(os.Args[1:]))
+}
+
+// run runs the command line args and returns the exit status.
+func (c *cli) run(args []string) int {
+
+	if len(args) == 0 {
+		c.usage()
+		return 2
+	}
+
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		c.usage()
+		return 0
+	}
+
+	var cmd *command
+
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+
+	if cmd == nil {
+		fmt.Fprintf(c.stderr, "qcon: unknown command %q\n", args[0])
+		c.usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := cmd.run(ctx, c, args[1:])
+
+	switch {
+	case err == nil:
+		return 0
+	case err == flag.ErrHelp:
+		return 0
+	case err == errFlags:
+		return 2
+	case err == errUsage:
+		fmt.Fprintf(c.stderr, "usage: qcon %s [flags] %s\n", cmd.name, cmd.args)
+		return 2
+	}
+
+	fmt.Fprintf(c.stderr, "qcon %s: %s\n", cmd.name, err)
+
+	return 1
+}
+
+func (c *cli) usage() {
+
+	fmt.Fprintf(c.stderr, "usage: qcon <command> [flags] [arguments]\n\ncommands:\n")
+
+	for _, cmd := range commands {
+		fmt.Fprintf(c.stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+
+	fmt.Fprintf(c.stderr, "\nRun \"qcon <command> -h\" for the flags of a command.\n")
+}
+
+// flagSet returns a FlagSet for the named command with the flags common
+// to all commands defined.
+func (c *cli) flagSet(name string) *flag.FlagSet {
+
+	fs := flag.NewFlagSet("qcon "+name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+
+	fs.DurationVar(&c.timeout, "timeout", 0, "timeout for connectivity checks (default 2s)")
+	fs.StringVar(&c.dns, "dns", "", "DNS server `address` for resolving DDNS and FQDN names")
+	fs.BoolVar(&c.publicOnly, "public-only", false, "only connect to public internet addresses")
+	fs.BoolVar(&c.strictTLS, "strict-tls", false, "only accept routes authenticated by TLS")
+	fs.BoolVar(&c.tunnel, "tunnel", false, "request a relay tunnel if no direct route answers")
+
+	return fs
+}
+
+// parse parses the command line args with fs.
+func (c *cli) parse(fs *flag.FlagSet, args []string) error {
+
+	err := fs.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return errFlags
+	}
+
+	return err
+}
+
+// qcon returns the Client to use, configured by the common flags.
+func (c *cli) qcon() *qcon.Client {
+
+	if c.client != nil {
+		return c.client
+	}
+
+	client := &qcon.Client{
+		Timeout:   c.timeout,
+		StrictTLS: c.strictTLS,
+		UseTunnel: c.tunnel,
+	}
+
+	if c.dns != "" {
+		client.Resolver = qcon.NewDNSResolver(c.dns)
+	}
+
+	if c.publicOnly {
+		client.Policy = qcon.PublicOnly()
+	}
+
+	return client
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"jbowen.dev/qcon/qcontest"
+)
+
+// newTestDevice starts a fake control server for a device "mynas"
+// reachable at 127.0.0.1, so that other ports on it are real local
+// listeners.
+func newTestDevice() *qcontest.Server {
+	return qcontest.NewServer(qcontest.Device{
+		ID:         "mynas",
+		ServerID:   "012345678",
+		Interfaces: []qcontest.Interface{{Name: "eth0", IP: "127.0.0.1", Mask: "255.0.0.0"}},
+		Endpoints: map[string]qcontest.Endpoint{
+			"http://127.0.0.1:5000": {},
+		},
+	})
+}
+
+// echoServer starts a TCP server echoing back what it receives and
+// returns its port.
+func echoServer(t *testing.T) (string, func()) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	return port, func() { ln.Close() }
+}
+
+func TestConnect(t *testing.T) {
+
+	srv := newTestDevice()
+	defer srv.Close()
+
+	port, stop := echoServer(t)
+	defer stop()
+
+	var out, errOut bytes.Buffer
+
+	client := srv.Client()
+	client.Timeout = 200 * time.Millisecond
+
+	c := &cli{
+		stdin:  strings.NewReader("SSH-2.0-test\r\n"),
+		stdout: &out,
+		stderr: &errOut,
+		client: client,
+	}
+
+	if s := c.run([]string{"connect", "mynas.quickconnect.to", port}); s != 0 {
+		t.Fatalf("exit status %d: %s", s, errOut.String())
+	}
+
+	if out.String() != "SSH-2.0-test\r\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestUsage(t *testing.T) {
+
+	tests := []struct {
+		args []string
+		exp  int
+	}{
+		{nil, 2},
+		{[]string{"help"}, 0},
+		{[]string{"bogus"}, 2},
+		{[]string{"connect", "mynas"}, 2},
+		{[]string{"connect", "mynas", "ssh"}, 2},
+		{[]string{"connect", "-h"}, 0},
+		{[]string{"proxy"}, 2},
+		{[]string{"proxy", "-listen"}, 2},
+		{[]string{"dns", "mynas"}, 2},
+		{[]string{"export", "-format", "xml", "mynas"}, 2},
+		{[]string{"serve", "mynas"}, 2},
+	}
+
+	for _, tc := range tests {
+		var errOut bytes.Buffer
+
+		c := &cli{stderr: &errOut}
+
+		if s := c.run(tc.args); s != tc.exp {
+			t.Errorf("%v: expected exit status %d, got %d", tc.args, tc.exp, s)
+		}
+	}
+}
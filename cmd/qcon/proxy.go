@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"jbowen.dev/qcon"
+)
+
+// runProxy serves a reverse proxy to the DSM web service of a device on
+// a local address until interrupted.
+func runProxy(ctx context.Context, c *cli, args []string) error {
+
+	fs := c.flagSet("proxy")
+	listen := fs.String("listen", "127.0.0.1:5001", "`address` to listen on")
+	refresh := fs.Duration("refresh", 10*time.Minute, "resolve the device again after this long (0 to disable)")
+
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	p := qcon.NewProxy(c.qcon(), fs.Arg(0))
+	p.Refresh = *refresh
+	defer p.Close()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stderr, "qcon: proxying http://%s to %s\n", ln.Addr(), fs.Arg(0))
+
+	return serve(ctx, &http.Server{Handler: p}, ln)
+}
+
+// serve runs srv on ln until ctx is cancelled, then shuts it down.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener) error {
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return srv.Shutdown(sctx)
+}
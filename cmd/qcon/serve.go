@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"jbowen.dev/qcon"
+)
+
+// runServe serves resolutions over HTTP for programs that cannot use
+// the library, until interrupted.
+func runServe(ctx context.Context, c *cli, args []string) error {
+
+	fs := c.flagSet("serve")
+	listen := fs.String("listen", "127.0.0.1:8750", "`address` to listen on, or unix:<path> for a Unix socket")
+	token := fs.String("token", "", "require this bearer `token` (default $QCON_TOKEN)")
+	ttl := fs.Duration("ttl", qcon.DefaultCacheTTL, "how long resolutions are cached")
+	interval := fs.Duration("interval", qcon.DefaultMonitorInterval, "how often resolved devices are checked for route changes")
+	idle := fs.Duration("idle", defaultWatchIdle, "stop checking devices not requested for this long (0 to never stop)")
+
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	if *token == "" {
+		*token = os.Getenv("QCON_TOKEN")
+	}
+
+	cache := qcon.NewCache(c.qcon())
+	cache.TTL = *ttl
+
+	mon := qcon.NewMonitor(cache)
+	mon.Interval = *interval
+
+	go mon.Run(ctx)
+
+	ln, err := listenAddr(*listen)
+	if err != nil {
+		return err
+	}
+
+	s := &apiServer{ctx: ctx, cache: cache, monitor: mon, token: *token}
+
+	if *idle > 0 {
+		go s.expireIdle(ctx, *idle)
+	}
+
+	fmt.Fprintf(c.stderr, "qcon: serving on %s\n", ln.Addr())
+
+	return serve(ctx, &http.Server{Handler: s.handler()}, ln)
+}
+
+// listenAddr listens on a TCP address, or on a Unix socket if addr is
+// of the form unix:<path>. A stale socket file is removed first.
+func listenAddr(addr string) (net.Listener, error) {
+
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// apiServer implements the HTTP API of qcon serve:
+//
+//	GET /v1/resolve/{id}  verified routes, best first
+//	GET /v1/info/{id}     all candidate routes with their state
+//	GET /v1/events?id=..  server-sent events for changes of best route
+//
+// Devices resolved successfully through the API are monitored for route
+// changes, up to maxWatched of them, until not requested for a while.
+type apiServer struct {
+	ctx     context.Context // done when shutting down
+	cache   *qcon.Cache
+	monitor *qcon.Monitor
+	token   string
+
+	mu        sync.Mutex
+	requested map[string]time.Time // monitored IDs by time last requested
+}
+
+const (
+	// maxWatched is the most devices monitored at once; others are
+	// still resolved but not monitored until some expire.
+	maxWatched = 1024
+
+	// defaultWatchIdle is how long a device is monitored after it was
+	// last requested.
+	defaultWatchIdle = time.Hour
+)
+
+// watch monitors the device with the given (parsed) ID, noting that it
+// has just been requested.
+func (s *apiServer) watch(id string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.requested == nil {
+		s.requested = make(map[string]time.Time)
+	}
+
+	if _, ok := s.requested[id]; !ok {
+		if len(s.requested) >= maxWatched {
+			return
+		}
+
+		s.monitor.Watch(id)
+	}
+
+	s.requested[id] = time.Now()
+}
+
+// expire stops monitoring devices not requested within idle.
+func (s *apiServer) expire(idle time.Duration) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.requested {
+		if time.Since(t) >= idle {
+			delete(s.requested, id)
+			s.monitor.Unwatch(id)
+		}
+	}
+}
+
+// expireIdle calls expire periodically until ctx is done.
+func (s *apiServer) expireIdle(ctx context.Context, idle time.Duration) {
+
+	ticker := time.NewTicker(idle / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expire(idle)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *apiServer) handler() http.Handler {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/resolve/", s.handleResolve)
+	mux.HandleFunc("/v1/info/", s.handleInfo)
+	mux.HandleFunc("/v1/events", s.handleEvents)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if s.token != "" {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="qcon"`)
+				writeJSON(w, http.StatusUnauthorized, apiError{"invalid or missing bearer token"})
+				return
+			}
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiRecord is the JSON form of a qcon.Record.
+type apiRecord struct {
+	URL        string `json:"url"`
+	Class      string `json:"class"`
+	State      string `json:"state"`
+	Sources    string `json:"sources,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newAPIRecord(r qcon.Record) apiRecord {
+
+	ar := apiRecord{
+		URL:        r.URL,
+		Class:      r.Class().String(),
+		State:      r.State.String(),
+		Sources:    r.Sources.String(),
+		ServerName: r.ServerName,
+	}
+
+	if r.Err != nil {
+		ar.Error = r.Err.Error()
+	}
+
+	return ar
+}
+
+func newAPIRecords(recs []qcon.Record) []apiRecord {
+
+	ars := make([]apiRecord, len(recs))
+
+	for i, r := range recs {
+		ars[i] = newAPIRecord(r)
+	}
+
+	return ars
+}
+
+// resolve looks up the device named by the final element of the request
+// path and, if it could be resolved, monitors it.
+func (s *apiServer) resolve(r *http.Request, prefix string) (*qcon.Resolution, time.Duration, error) {
+
+	id, err := qcon.ParseID(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, ttl, err := s.cache.Resolve(r.Context(), id)
+	if err == nil {
+		s.watch(id)
+	}
+
+	return res, ttl, err
+}
+
+func (s *apiServer) handleResolve(w http.ResponseWriter, r *http.Request) {
+
+	res, ttl, err := s.resolve(r, "/v1/resolve/")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		ID       string      `json:"id"`
+		ServerID string      `json:"server_id"`
+		Best     apiRecord   `json:"best"`
+		URLs     []string    `json:"urls"`
+		Records  []apiRecord `json:"records"`
+		Tunnel   bool        `json:"tunnel"`
+		Resolved time.Time   `json:"resolved"`
+		TTL      int         `json:"ttl"`
+	}{
+		ID:       res.Info.ID,
+		ServerID: res.Info.ServerID,
+		Best:     newAPIRecord(res.Best),
+		URLs:     res.URLs(),
+		Records:  newAPIRecords(res.Records),
+		Tunnel:   res.Tunnel,
+		Resolved: res.End,
+		TTL:      int(ttl.Seconds()),
+	})
+}
+
+func (s *apiServer) handleInfo(w http.ResponseWriter, r *http.Request) {
+
+	res, _, err := s.resolve(r, "/v1/info/")
+	if res == nil {
+		writeError(w, err)
+		return
+	}
+
+	type skipped struct {
+		Address string `json:"address"`
+		Reason  string `json:"reason"`
+	}
+
+	var skips []skipped
+
+	for _, sk := range res.Info.Skipped {
+		skips = append(skips, skipped{sk.Address, sk.Reason.Error()})
+	}
+
+	var errText string
+	if err != nil {
+		errText = err.Error()
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		ID       string          `json:"id"`
+		ServerID string          `json:"server_id"`
+		Error    string          `json:"error,omitempty"`
+		Records  []apiRecord     `json:"records"`
+		Skipped  []skipped       `json:"skipped,omitempty"`
+		HTTPS    qcon.ServerInfo `json:"https"`
+		HTTP     qcon.ServerInfo `json:"http"`
+	}{
+		ID:       res.Info.ID,
+		ServerID: res.Info.ServerID,
+		Error:    errText,
+		Records:  newAPIRecords(res.Info.Records),
+		Skipped:  skips,
+		HTTPS:    res.Info.HTTPS,
+		HTTP:     res.Info.HTTP,
+	})
+}
+
+// keepAliveInterval is how often a comment is sent on idle event
+// streams so that proxies do not time them out.
+const keepAliveInterval = 15 * time.Second
+
+// handleEvents streams RouteChanges of monitored devices, or only those
+// given by id query parameters, as server-sent "route" events. The given
+// devices must resolve, and are then monitored while the stream is open.
+func (s *apiServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, apiError{"streaming not supported"})
+		return
+	}
+
+	changes, stop := s.monitor.Subscribe()
+	defer stop()
+
+	ids := make(map[string]bool)
+
+	for _, id := range r.URL.Query()["id"] {
+		id, err := qcon.ParseID(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		ids[id] = true
+	}
+
+	for id := range ids {
+		if _, _, err := s.cache.Resolve(r.Context(), id); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		s.watch(id)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case rc := <-changes:
+			if len(ids) > 0 && !ids[rc.ID] {
+				break
+			}
+
+			ev := struct {
+				ID      string    `json:"id"`
+				Time    time.Time `json:"time"`
+				URL     string    `json:"url"`
+				Prev    string    `json:"previous,omitempty"`
+				Error   string    `json:"error,omitempty"`
+				Initial bool      `json:"initial,omitempty"`
+			}{ID: rc.ID, Time: rc.Time, URL: rc.URL, Prev: rc.Prev, Initial: rc.Initial}
+
+			if rc.Err != nil {
+				ev.Error = rc.Err.Error()
+			}
+
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: route\ndata: %s\n\n", data)
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			for id := range ids {
+				s.watch(id)
+			}
+
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// writeError writes err with a status code reflecting its cause.
+func writeError(w http.ResponseWriter, err error) {
+
+	status := http.StatusBadGateway
+
+	switch {
+	case err == qcon.ErrInvalidID:
+		status = http.StatusBadRequest
+	case err == qcon.ErrCannotAccess, errors.Is(err, qcon.ErrDeviceOffline), err == qcon.ErrCancelled:
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
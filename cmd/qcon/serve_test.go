@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"jbowen.dev/qcon"
+)
+
+func TestServe(t *testing.T) {
+
+	srv := newTestDevice()
+	defer srv.Close()
+
+	client := srv.Client()
+	client.Timeout = 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := qcon.NewCache(client)
+	mon := qcon.NewMonitor(cache)
+
+	go mon.Run(ctx)
+
+	s := &apiServer{ctx: ctx, cache: cache, monitor: mon, token: "secret"}
+
+	api := httptest.NewServer(s.handler())
+	defer api.Close()
+
+	get := func(path, token string) *http.Response {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodGet, api.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	statuses := []struct {
+		path  string
+		token string
+		exp   int
+	}{
+		{"/v1/resolve/mynas", "", http.StatusUnauthorized},
+		{"/v1/resolve/mynas", "wrong", http.StatusUnauthorized},
+		{"/v1/resolve/not%20valid", "secret", http.StatusBadRequest},
+		{"/v1/resolve/nobody", "secret", http.StatusBadGateway},
+		{"/v1/other", "secret", http.StatusNotFound},
+	}
+
+	for _, tc := range statuses {
+		resp := get(tc.path, tc.token)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.exp {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.exp, resp.StatusCode)
+		}
+	}
+
+	// Devices that fail to resolve are not monitored
+	if w := mon.Watched(); len(w) != 0 {
+		t.Errorf("unexpected devices monitored: %v", w)
+	}
+
+	resp := get("/v1/events?id=nobody", "secret")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway || len(mon.Watched()) != 0 {
+		t.Errorf("expected unknown device to be refused for events, got %d", resp.StatusCode)
+	}
+
+	// Subscribe before resolving so the initial route is reported
+	events := get("/v1/events?id=mynas", "secret")
+	defer events.Body.Close()
+
+	if ct := events.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected event stream type %s", ct)
+	}
+
+	resp = get("/v1/resolve/MyNAS", "secret")
+
+	var res struct {
+		ID       string   `json:"id"`
+		ServerID string   `json:"server_id"`
+		URLs     []string `json:"urls"`
+		Best     struct {
+			URL   string `json:"url"`
+			State string `json:"state"`
+		} `json:"best"`
+		TTL int `json:"ttl"`
+	}
+
+	err := json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("resolve failed: %d %v", resp.StatusCode, err)
+	}
+
+	if res.ID != "mynas" || res.ServerID != "012345678" || res.Best.URL != "http://127.0.0.1:5000" ||
+		res.Best.State != "ok" || len(res.URLs) != 1 || res.TTL <= 0 {
+		t.Errorf("unexpected resolution %+v", res)
+	}
+
+	resp = get("/v1/info/mynas", "secret")
+
+	var info struct {
+		Records []struct {
+			URL   string `json:"url"`
+			State string `json:"state"`
+			Error string `json:"error"`
+		} `json:"records"`
+		HTTPS qcon.ServerInfo `json:"https"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+
+	if err != nil || len(info.Records) < 2 || info.HTTPS.Server.ServerID != "012345678" {
+		t.Fatalf("unexpected info: %v %+v", err, info)
+	}
+
+	for _, r := range info.Records {
+		if r.State != "ok" && r.Error == "" {
+			t.Errorf("%s: state %s without error", r.URL, r.State)
+		}
+	}
+
+	// The first event is the initial route of the device
+	done := make(chan string)
+
+	go func() {
+		sc := bufio.NewScanner(events.Body)
+		for sc.Scan() {
+			if strings.HasPrefix(sc.Text(), "data: ") {
+				done <- strings.TrimPrefix(sc.Text(), "data: ")
+				return
+			}
+		}
+		close(done)
+	}()
+
+	select {
+	case data := <-done:
+		var ev struct {
+			ID      string `json:"id"`
+			URL     string `json:"url"`
+			Initial bool   `json:"initial"`
+		}
+
+		if err := json.Unmarshal([]byte(data), &ev); err != nil || ev.ID != "mynas" || ev.URL != "http://127.0.0.1:5000" || !ev.Initial {
+			t.Errorf("unexpected event %s", data)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	if w := mon.Watched(); len(w) != 1 || w[0] != "mynas" {
+		t.Errorf("expected mynas to be monitored, got %v", w)
+	}
+
+	// Devices not requested within the idle time stop being monitored
+	s.expire(0)
+
+	if w := mon.Watched(); len(w) != 0 {
+		t.Errorf("expected idle devices to expire, got %v", w)
+	}
+
+	// Once maxWatched devices are monitored, no more are added
+	s.mu.Lock()
+	for i := 0; i < maxWatched; i++ {
+		s.requested[fmt.Sprintf("dev%d", i)] = time.Now()
+	}
+	s.mu.Unlock()
+
+	resp = get("/v1/resolve/mynas", "secret")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || len(mon.Watched()) != 0 {
+		t.Errorf("expected mynas to be resolved but not monitored: %d %v", resp.StatusCode, mon.Watched())
+	}
+}
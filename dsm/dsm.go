@@ -0,0 +1,495 @@
+/*
+Package dsm is a client for the Synology DSM Web API that reaches the
+device through qcon, so it is addressed by QuickConnect ID rather than
+by URL:
+
+	c := dsm.New("mynas", nil)
+
+	if err := c.Login(ctx, "admin", password, ""); err != nil {
+		// handle error
+	}
+	defer c.Logout(ctx)
+
+	info, err := c.DSMInfo(ctx)
+
+The device is resolved on first use and requests are sent over the best
+verified route, with certificates checked against the device's hostname
+as by qcon.Proxy. The APIs the device provides are discovered through
+SYNO.API.Info. If the route cannot be connected to, the device is
+resolved again and the request retried once on the new best route.
+Requests are not retried once sent, as they may not be idempotent.
+
+Passwords and session IDs are only sent over HTTPS routes; requests
+carrying them fail with ErrInsecure on an HTTP route unless AllowHTTP
+is set.
+
+Other APIs are called with Call, which decodes the data of a successful
+reply into the given value. DSM error codes are returned as *Error.
+*/
+package dsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"jbowen.dev/qcon"
+)
+
+// Client is a DSM Web API client for the device with a QuickConnect
+// ID. Its methods are safe for concurrent use.
+type Client struct {
+	ID      string       // QuickConnect ID of the device
+	QC      *qcon.Client // used to resolve ID, qcon.DefaultClient if nil
+	Session string       // session name sent on Login, if set
+
+	// AllowHTTP permits Login and calls in a session over HTTP routes,
+	// sending the password and session ID unencrypted.
+	AllowHTTP bool
+
+	mu      sync.Mutex
+	route   *route
+	pending *resolving // resolution in progress, if any
+	apis    map[string]APIInfo
+	sid     string
+}
+
+// resolving is a resolution of the device shared by concurrent
+// requests. err is set before done is closed.
+type resolving struct {
+	done chan struct{}
+	err  error
+}
+
+// route is the connection to the device over the best route of a
+// Resolution.
+type route struct {
+	res  *qcon.Resolution
+	base string // URL of the route, without trailing slash
+	http *http.Client
+}
+
+// APIInfo describes an API provided by the device, as reported by
+// SYNO.API.Info.
+type APIInfo struct {
+	Path          string `json:"path"` // relative to /webapi/
+	MinVersion    int    `json:"minVersion"`
+	MaxVersion    int    `json:"maxVersion"`
+	RequestFormat string `json:"requestFormat,omitempty"`
+}
+
+// New returns a Client for the device with the given QuickConnect ID,
+// resolved with qc. The device is not contacted until first used.
+func New(id string, qc *qcon.Client) *Client {
+	return &Client{ID: id, QC: qc}
+}
+
+// NewFromResolution returns a Client using the best route of an
+// existing resolution of a device. qc is used to resolve the device
+// again if the route fails.
+func NewFromResolution(res *qcon.Resolution, qc *qcon.Client) *Client {
+
+	c := &Client{ID: res.Info.ID, QC: qc}
+	c.route = c.newRoute(res)
+
+	return c
+}
+
+func (c *Client) qc() *qcon.Client {
+
+	if c.QC == nil {
+		return qcon.DefaultClient
+	}
+
+	return c.QC
+}
+
+func (c *Client) newRoute(res *qcon.Resolution) *route {
+
+	return &route{
+		res:  res,
+		base: strings.TrimSuffix(res.Best.URL, "/"),
+		http: &http.Client{
+			Transport: c.qc().Transport(res.Best, &res.Info),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// URL returns the URL of the route in use, or an empty string if the
+// device has not been resolved yet.
+func (c *Client) URL() string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.route == nil {
+		return ""
+	}
+
+	return c.route.base
+}
+
+// Resolution returns the resolution of the device the route in use was
+// chosen from, or nil if the device has not been resolved yet.
+func (c *Client) Resolution() *qcon.Resolution {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.route == nil {
+		return nil
+	}
+
+	return c.route.res
+}
+
+// SID returns the session ID obtained by Login, if any.
+func (c *Client) SID() string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sid
+}
+
+// Close closes idle connections to the device.
+func (c *Client) Close() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.route != nil {
+		c.route.http.CloseIdleConnections()
+	}
+}
+
+// connect returns the route to use, resolving the device if there is
+// none or if the route is the failed one. The device is resolved
+// without holding c.mu, and only once for concurrent requests; if the
+// request resolving it is cancelled, a waiting request takes over.
+func (c *Client) connect(ctx context.Context, failed *route) (*route, error) {
+
+	for {
+		c.mu.Lock()
+
+		if c.route != nil && c.route != failed {
+			rt := c.route
+			c.mu.Unlock()
+			return rt, nil
+		}
+
+		if c.ID == "" {
+			c.mu.Unlock()
+			return nil, qcon.ErrInvalidID
+		}
+
+		if rv := c.pending; rv != nil {
+			c.mu.Unlock()
+
+			select {
+			case <-rv.done:
+			case <-ctx.Done():
+				return nil, qcon.ErrCancelled
+			}
+
+			if rv.err != nil && rv.err != qcon.ErrCancelled {
+				return nil, rv.err
+			}
+
+			continue
+		}
+
+		rv := &resolving{done: make(chan struct{})}
+		c.pending = rv
+
+		c.mu.Unlock()
+
+		res, err := c.qc().ResolveDetailed(ctx, c.ID)
+
+		c.mu.Lock()
+
+		c.pending = nil
+
+		if err == nil {
+			if c.route != nil {
+				c.route.http.CloseIdleConnections()
+			}
+
+			c.route = c.newRoute(res)
+		}
+
+		rt := c.route
+
+		c.mu.Unlock()
+
+		rv.err = err
+		close(rv.done)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return rt, nil
+	}
+}
+
+// response is the envelope of every DSM Web API reply.
+type response struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	Error   *struct {
+		Code   int             `json:"code"`
+		Errors json.RawMessage `json:"errors"`
+	} `json:"error"`
+}
+
+// do sends a request for api to path (relative to /webapi/), retrying
+// once over a newly resolved route if the route cannot be connected to,
+// and decodes the data of a successful reply into result unless it is
+// nil. Requests carrying credentials are refused over HTTP routes unless
+// AllowHTTP is set.
+func (c *Client) do(ctx context.Context, path, api, method string, params url.Values, result interface{}) error {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var rt *route
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; attempt < 2; attempt++ {
+		rt, err = c.connect(ctx, rt)
+		if err != nil {
+			return err
+		}
+
+		if !c.AllowHTTP && !strings.HasPrefix(rt.base, "https:") &&
+			(params.Get("passwd") != "" || params.Get("_sid") != "") {
+			return ErrInsecure
+		}
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, rt.base+"/webapi/"+path, strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		resp, err = rt.http.Do(req)
+		if err == nil {
+			break
+		}
+
+		if ctx.Err() != nil {
+			return qcon.ErrCancelled
+		}
+
+		if !isDialError(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{API: api, Status: resp.StatusCode}
+	}
+
+	var r response
+
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return qcon.ErrParse
+	}
+
+	if !r.Success {
+		if r.Error == nil {
+			return &Error{Code: CodeUnknown, API: api, Method: method}
+		}
+		return &Error{Code: r.Error.Code, API: api, Method: method, Errors: r.Error.Errors}
+	}
+
+	if result != nil && len(r.Data) > 0 {
+		if err := json.Unmarshal(r.Data, result); err != nil {
+			return qcon.ErrParse
+		}
+	}
+
+	return nil
+}
+
+// isDialError reports whether err is a failure to connect, so that the
+// request was not sent.
+func isDialError(err error) bool {
+
+	var op *net.OpError
+
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// APIs returns the APIs provided by the device, keyed by name. They are
+// queried from SYNO.API.Info on first use and cached.
+func (c *Client) APIs(ctx context.Context) (map[string]APIInfo, error) {
+
+	c.mu.Lock()
+	apis := c.apis
+	c.mu.Unlock()
+
+	if apis != nil {
+		return apis, nil
+	}
+
+	params := url.Values{
+		"api":     {"SYNO.API.Info"},
+		"version": {"1"},
+		"method":  {"query"},
+		"query":   {"all"},
+	}
+
+	if err := c.do(ctx, "query.cgi", "SYNO.API.Info", "query", params, &apis); err != nil {
+		return nil, err
+	}
+
+	if apis == nil {
+		apis = make(map[string]APIInfo)
+	}
+
+	c.mu.Lock()
+	c.apis = apis
+	c.mu.Unlock()
+
+	return apis, nil
+}
+
+// Call calls method of api with the given parameters and decodes the
+// data of the reply into result, unless it is nil. A version of 0 calls
+// the highest version the device provides. The session ID is added if
+// logged in.
+//
+// An *Error is returned if DSM reports failure, including when the
+// device does not provide api (CodeNoSuchAPI) or the version requested
+// (CodeVersion).
+func (c *Client) Call(ctx context.Context, api, method string, version int, params url.Values, result interface{}) error {
+
+	apis, err := c.APIs(ctx)
+	if err != nil {
+		return err
+	}
+
+	ai, ok := apis[api]
+	if !ok {
+		return &Error{Code: CodeNoSuchAPI, API: api, Method: method}
+	}
+
+	if version == 0 {
+		version = ai.MaxVersion
+	}
+
+	if version < ai.MinVersion || version > ai.MaxVersion {
+		return &Error{Code: CodeVersion, API: api, Method: method}
+	}
+
+	p := url.Values{}
+	for k, v := range params {
+		p[k] = v
+	}
+
+	p.Set("api", api)
+	p.Set("method", method)
+	p.Set("version", strconv.Itoa(version))
+
+	if sid := c.SID(); sid != "" && p.Get("_sid") == "" {
+		p.Set("_sid", sid)
+	}
+
+	return c.do(ctx, ai.Path, api, method, p, result)
+}
+
+// Login authenticates to DSM through SYNO.API.Auth, so that following
+// calls are made in the session. otp is the two-factor authentication
+// code, if required. ErrInsecure is returned if the route is not HTTPS,
+// unless AllowHTTP is set.
+func (c *Client) Login(ctx context.Context, account, passwd, otp string) error {
+
+	params := url.Values{
+		"account": {account},
+		"passwd":  {passwd},
+		"format":  {"sid"},
+	}
+
+	if otp != "" {
+		params.Set("otp_code", otp)
+	}
+
+	if c.Session != "" {
+		params.Set("session", c.Session)
+	}
+
+	var data struct {
+		SID string `json:"sid"`
+	}
+
+	if err := c.Call(ctx, "SYNO.API.Auth", "login", 0, params, &data); err != nil {
+		return err
+	}
+
+	if data.SID == "" {
+		return qcon.ErrParse
+	}
+
+	c.mu.Lock()
+	c.sid = data.SID
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Logout ends the session started by Login.
+func (c *Client) Logout(ctx context.Context) error {
+
+	params := url.Values{}
+
+	if c.Session != "" {
+		params.Set("session", c.Session)
+	}
+
+	err := c.Call(ctx, "SYNO.API.Auth", "logout", 0, params, nil)
+
+	c.mu.Lock()
+	c.sid = ""
+	c.mu.Unlock()
+
+	return err
+}
+
+// DSMInfo is the data returned by SYNO.DSM.Info getinfo.
+type DSMInfo struct {
+	Model       string `json:"model"`
+	Serial      string `json:"serial"`
+	Version     string `json:"version_string"`
+	RAM         int    `json:"ram"` // in MB
+	Temperature int    `json:"temperature"`
+	Uptime      int64  `json:"uptime"` // in seconds
+	Timezone    string `json:"time_zone"`
+}
+
+// DSMInfo returns basic information about the device. It requires a
+// session.
+func (c *Client) DSMInfo(ctx context.Context) (*DSMInfo, error) {
+
+	var info DSMInfo
+
+	if err := c.Call(ctx, "SYNO.DSM.Info", "getinfo", 0, nil, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
@@ -0,0 +1,347 @@
+package dsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"jbowen.dev/qcon"
+	"jbowen.dev/qcon/qcontest"
+)
+
+// fakeDSM serves enough of the DSM Web API for the tests: discovery,
+// login as admin/secret (account otp also requires an OTP code) and
+// SYNO.DSM.Info getinfo.
+var fakeDSM = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	reply := func(data interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+	}
+
+	fail := func(code int) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": map[string]int{"code": code}})
+	}
+
+	api, method := r.Form.Get("api"), r.Form.Get("method")
+
+	switch {
+	case r.URL.Path == "/webapi/query.cgi" && api == "SYNO.API.Info":
+		reply(map[string]APIInfo{
+			"SYNO.API.Info": {Path: "query.cgi", MinVersion: 1, MaxVersion: 1},
+			"SYNO.API.Auth": {Path: "auth.cgi", MinVersion: 1, MaxVersion: 7},
+			"SYNO.DSM.Info": {Path: "entry.cgi", MinVersion: 1, MaxVersion: 2},
+		})
+
+	case r.URL.Path == "/webapi/auth.cgi" && api == "SYNO.API.Auth" && method == "login":
+		switch {
+		case r.Form.Get("account") == "otp" && r.Form.Get("otp_code") == "":
+			fail(CodeOTPRequired)
+		case r.Form.Get("passwd") != "secret":
+			fail(CodeBadCredentials)
+		default:
+			reply(map[string]string{"sid": "s1"})
+		}
+
+	case r.URL.Path == "/webapi/auth.cgi" && api == "SYNO.API.Auth" && method == "logout":
+		reply(nil)
+
+	case r.URL.Path == "/webapi/entry.cgi" && api == "SYNO.DSM.Info":
+		switch {
+		case r.Form.Get("version") != "2":
+			fail(CodeVersion)
+		case r.Form.Get("_sid") != "s1":
+			fail(CodeSessionNotFound)
+		default:
+			reply(map[string]interface{}{"model": "DS920+", "version_string": "DSM 7.2-64570", "ram": 4096})
+		}
+
+	default:
+		fail(CodeNoSuchAPI)
+	}
+})
+
+// newTestDevice starts a fake control server for a device "mynas"
+// serving the fake DSM over HTTPS on two LAN addresses.
+func newTestDevice() *qcontest.Server {
+	return qcontest.NewServer(qcontest.Device{
+		ID:       "mynas",
+		ServerID: "012345678",
+		Interfaces: []qcontest.Interface{
+			{Name: "eth0", IP: "10.0.0.5", Mask: "255.255.255.0"},
+			{Name: "eth1", IP: "10.0.1.5", Mask: "255.255.255.0"},
+		},
+		Endpoints: map[string]qcontest.Endpoint{
+			"https://10.0.0.5:5001": {Handler: fakeDSM},
+			"https://10.0.1.5:5001": {Handler: fakeDSM},
+		},
+	})
+}
+
+func TestClient(t *testing.T) {
+
+	srv := newTestDevice()
+	defer srv.Close()
+
+	qc := srv.Client()
+	qc.Timeout = 200 * time.Millisecond
+
+	ctx := context.Background()
+
+	c := New("mynas", qc)
+	defer c.Close()
+
+	if err := c.Login(ctx, "admin", "wrong", ""); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("expected ErrBadCredentials, got %v", err)
+	}
+
+	if err := c.Login(ctx, "otp", "secret", ""); !errors.Is(err, ErrOTPRequired) {
+		t.Errorf("expected ErrOTPRequired, got %v", err)
+	}
+
+	if _, err := c.DSMInfo(ctx); !errors.Is(err, ErrSession) {
+		t.Errorf("expected ErrSession before login, got %v", err)
+	}
+
+	if err := c.Login(ctx, "admin", "secret", ""); err != nil || c.SID() != "s1" {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	info, err := c.DSMInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Model != "DS920+" || info.Version != "DSM 7.2-64570" || info.RAM != 4096 {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	// Errors detected from the discovered APIs
+	var e *Error
+
+	err = c.Call(ctx, "SYNO.Core.Missing", "list", 0, nil, nil)
+	if !errors.As(err, &e) || e.Code != CodeNoSuchAPI || !errors.Is(err, ErrNoSuchAPI) {
+		t.Errorf("expected CodeNoSuchAPI, got %v", err)
+	}
+
+	err = c.Call(ctx, "SYNO.DSM.Info", "getinfo", 3, nil, nil)
+	if !errors.As(err, &e) || e.Code != CodeVersion {
+		t.Errorf("expected CodeVersion, got %v", err)
+	}
+
+	// Version 1 is provided but rejected by the fake
+	err = c.Call(ctx, "SYNO.DSM.Info", "getinfo", 1, nil, nil)
+	if exp := "dsm: SYNO.DSM.Info getinfo: requested version not supported (code 104)"; err == nil || err.Error() != exp {
+		t.Errorf("unexpected error:\n  exp: %s\n  got: %v", exp, err)
+	}
+
+	// When the route in use fails, the device is resolved again
+	first := c.URL()
+	srv.Add(qcontest.Device{
+		ID:       "mynas",
+		ServerID: "012345678",
+		Interfaces: []qcontest.Interface{
+			{Name: "eth0", IP: "10.0.0.5", Mask: "255.255.255.0"},
+			{Name: "eth1", IP: "10.0.1.5", Mask: "255.255.255.0"},
+		},
+		Endpoints: map[string]qcontest.Endpoint{
+			first: {Fail: true},
+		},
+	})
+
+	// Drop kept-alive connections, which the route shares with qc, so
+	// the failed route is dialled again
+	qc.Client.Transport.(*http.Transport).CloseIdleConnections()
+
+	if _, err := c.DSMInfo(ctx); err != nil {
+		t.Fatalf("call after route failure: %v", err)
+	}
+
+	if u := c.URL(); u == first || !strings.HasPrefix(u, "https://10.0.") {
+		t.Errorf("expected a new route, got %s (was %s)", u, first)
+	}
+
+	if err := c.Logout(ctx); err != nil || c.SID() != "" {
+		t.Errorf("logout failed: %v", err)
+	}
+}
+
+func TestNewFromResolution(t *testing.T) {
+
+	srv := newTestDevice()
+	defer srv.Close()
+
+	qc := srv.Client()
+	qc.Timeout = 200 * time.Millisecond
+
+	ctx := context.Background()
+
+	res, err := qc.ResolveDetailed(ctx, "mynas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewFromResolution(res, qc)
+	defer c.Close()
+
+	if c.URL() != res.Best.URL || c.Resolution() != res {
+		t.Errorf("resolution not used: %s", c.URL())
+	}
+
+	apis, err := c.APIs(ctx)
+	if err != nil || apis["SYNO.API.Auth"].Path != "auth.cgi" {
+		t.Errorf("unexpected APIs %v: %v", apis, err)
+	}
+
+	// Unknown devices are reported by qcon
+	c = New("nobody", qc)
+
+	err = c.Call(ctx, "SYNO.API.Auth", "login", 0, url.Values{}, nil)
+	if _, ok := err.(*Error); err == nil || ok {
+		t.Errorf("expected qcon error for unknown device, got %v", err)
+	}
+
+	if c.Resolution() != nil {
+		t.Error("unexpected resolution")
+	}
+}
+
+func TestInsecure(t *testing.T) {
+
+	srv := qcontest.NewServer(qcontest.Device{
+		ID:         "mynas",
+		ServerID:   "012345678",
+		Interfaces: []qcontest.Interface{{Name: "eth0", IP: "10.0.0.5", Mask: "255.255.255.0"}},
+		Endpoints: map[string]qcontest.Endpoint{
+			"http://10.0.0.5:5000": {Handler: fakeDSM},
+		},
+	})
+	defer srv.Close()
+
+	qc := srv.Client()
+	qc.Timeout = 200 * time.Millisecond
+
+	ctx := context.Background()
+
+	c := New("mynas", qc)
+	defer c.Close()
+
+	// Credentials are not sent over HTTP, though other calls are
+	if err := c.Login(ctx, "admin", "secret", ""); err != ErrInsecure {
+		t.Errorf("expected ErrInsecure, got %v", err)
+	}
+
+	if _, err := c.APIs(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	c.AllowHTTP = true
+
+	if err := c.Login(ctx, "admin", "secret", ""); err != nil {
+		t.Errorf("login with AllowHTTP failed: %v", err)
+	}
+}
+
+func TestNoRetryAfterSend(t *testing.T) {
+
+	var posts int32
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/webapi/entry.cgi" {
+			atomic.AddInt32(&posts, 1)
+			panic(http.ErrAbortHandler) // drop the connection without replying
+		}
+		fakeDSM(w, r)
+	})
+
+	srv := qcontest.NewServer(qcontest.Device{
+		ID:         "mynas",
+		ServerID:   "012345678",
+		Interfaces: []qcontest.Interface{{Name: "eth0", IP: "10.0.0.5", Mask: "255.255.255.0"}},
+		Endpoints: map[string]qcontest.Endpoint{
+			"https://10.0.0.5:5001": {Handler: handler},
+		},
+	})
+	defer srv.Close()
+
+	qc := srv.Client()
+	qc.Timeout = 200 * time.Millisecond
+
+	c := New("mynas", qc)
+	defer c.Close()
+
+	if err := c.Call(context.Background(), "SYNO.DSM.Info", "getinfo", 0, nil, nil); err == nil {
+		t.Error("expected error when connection is dropped")
+	}
+
+	if n := atomic.LoadInt32(&posts); n != 1 {
+		t.Errorf("expected request to be sent once, sent %d times", n)
+	}
+}
+
+func TestResolveUnlocked(t *testing.T) {
+
+	srv := qcontest.NewServer(qcontest.Device{
+		ID:         "mynas",
+		ServerID:   "012345678",
+		Interfaces: []qcontest.Interface{{Name: "eth0", IP: "10.0.0.5", Mask: "255.255.255.0"}},
+		Endpoints: map[string]qcontest.Endpoint{
+			"https://10.0.0.5:5001": {Handler: fakeDSM, Delay: 300 * time.Millisecond},
+		},
+	})
+	defer srv.Close()
+
+	qc := srv.Client()
+	qc.Timeout = time.Second
+
+	c := New("mynas", qc)
+	defer c.Close()
+
+	// Requests made while the device is resolved share the resolution,
+	// and other methods are not held up by it
+	first, cancel := context.WithCancel(context.Background())
+
+	errc := make(chan error, 2)
+
+	go func() {
+		_, err := c.APIs(first)
+		errc <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		_, err := c.APIs(context.Background())
+		errc <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+
+	c.SID()
+	c.URL()
+	c.Close()
+
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("methods blocked for %s during resolution", d)
+	}
+
+	// The waiting request takes over when the first is cancelled
+	cancel()
+
+	if err := <-errc; err != qcon.ErrCancelled {
+		t.Errorf("expected ErrCancelled for cancelled request, got %v", err)
+	}
+
+	if err := <-errc; err != nil {
+		t.Errorf("unexpected error for waiting request: %v", err)
+	}
+}
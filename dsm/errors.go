@@ -0,0 +1,122 @@
+package dsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes common to all DSM Web APIs.
+const (
+	CodeUnknown         = 100
+	CodeBadParameter    = 101
+	CodeNoSuchAPI       = 102
+	CodeNoSuchMethod    = 103
+	CodeVersion         = 104
+	CodePermission      = 105
+	CodeSessionTimeout  = 106
+	CodeDuplicateLogin  = 107
+	CodeSessionNotFound = 119
+)
+
+// Error codes of SYNO.API.Auth.
+const (
+	CodeBadCredentials   = 400
+	CodeAccountDisabled  = 401
+	CodePermissionDenied = 402
+	CodeOTPRequired      = 403
+	CodeOTPFailed        = 404
+)
+
+var (
+	ErrNoSuchAPI      error = errors.New("API not provided by device")
+	ErrPermission     error = errors.New("permission denied")
+	ErrSession        error = errors.New("session expired or not found")
+	ErrBadCredentials error = errors.New("invalid account or password")
+	ErrOTPRequired    error = errors.New("two-factor authentication code required")
+	ErrInsecure       error = errors.New("credentials not sent over an unencrypted route")
+)
+
+var commonErrors = map[int]string{
+	CodeUnknown:         "unknown error",
+	CodeBadParameter:    "invalid parameter",
+	CodeNoSuchAPI:       "requested API does not exist",
+	CodeNoSuchMethod:    "requested method does not exist",
+	CodeVersion:         "requested version not supported",
+	CodePermission:      "permission denied",
+	CodeSessionTimeout:  "session timed out",
+	CodeDuplicateLogin:  "session interrupted by duplicate login",
+	CodeSessionNotFound: "session ID not found",
+}
+
+var authErrors = map[int]string{
+	CodeBadCredentials:   "invalid account or password",
+	CodeAccountDisabled:  "account disabled",
+	CodePermissionDenied: "permission denied",
+	CodeOTPRequired:      "two-factor authentication code required",
+	CodeOTPFailed:        "two-factor authentication failed",
+}
+
+// Error is returned when DSM reports that a request failed. Codes
+// below 400 have the same meaning for every API; the meaning of others
+// depends on API. It matches the sentinel errors of this package with
+// errors.Is according to Code:
+//
+//	ErrNoSuchAPI       CodeNoSuchAPI
+//	ErrPermission      CodePermission, or CodePermissionDenied from SYNO.API.Auth
+//	ErrSession         CodeSessionTimeout, CodeDuplicateLogin, CodeSessionNotFound
+//	ErrBadCredentials  CodeBadCredentials from SYNO.API.Auth
+//	ErrOTPRequired     CodeOTPRequired from SYNO.API.Auth
+type Error struct {
+	Code   int
+	API    string
+	Method string
+	Errors json.RawMessage // further details given by some APIs
+}
+
+func (e *Error) Error() string {
+
+	msg, ok := commonErrors[e.Code]
+	if !ok && e.API == "SYNO.API.Auth" {
+		msg, ok = authErrors[e.Code]
+	}
+
+	if !ok {
+		msg = "error"
+	}
+
+	return fmt.Sprintf("dsm: %s %s: %s (code %d)", e.API, e.Method, msg, e.Code)
+}
+
+// Is reports whether target is the sentinel error for e.Code.
+func (e *Error) Is(target error) bool {
+
+	auth := e.API == "SYNO.API.Auth"
+
+	switch target {
+	case ErrNoSuchAPI:
+		return e.Code == CodeNoSuchAPI
+	case ErrPermission:
+		return e.Code == CodePermission || auth && e.Code == CodePermissionDenied
+	case ErrSession:
+		return e.Code == CodeSessionTimeout || e.Code == CodeDuplicateLogin || e.Code == CodeSessionNotFound
+	case ErrBadCredentials:
+		return auth && e.Code == CodeBadCredentials
+	case ErrOTPRequired:
+		return auth && e.Code == CodeOTPRequired
+	}
+
+	return false
+}
+
+// StatusError is returned when the device answers a request with an
+// HTTP status other than 200 OK.
+type StatusError struct {
+	API    string
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("dsm: %s: unexpected HTTP status %d %s", e.API, e.Status, http.StatusText(e.Status))
+}
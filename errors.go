@@ -1,6 +1,10 @@
 package qcon
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net"
+)
 
 var (
 	ErrTimeout           error = errors.New("operation timed out")
@@ -11,4 +15,123 @@ var (
 	ErrPingFailure       error = errors.New("ping response failure")
 	ErrUnknownCommand    error = errors.New("unknown command")
 	ErrUnknownServerType error = errors.New("unknown server type")
+	ErrNoZone            error = errors.New("no local interface for IPv6 link-local address")
+	ErrDeviceOffline     error = errors.New("device offline")
+	ErrInvalidShareLink  error = errors.New("invalid share link")
+	ErrPinMismatch       error = errors.New("certificate does not match pin")
+	ErrBlocked           error = errors.New("address blocked by policy")
+	ErrUntrustedTLS      error = errors.New("connection not authenticated by TLS")
+	ErrTunnel            error = errors.New("tunnel routes only carry DSM web traffic")
+)
+
+// OfflineError is returned when the QuickConnect server reports the
+// device is not connected to it. It matches ErrDeviceOffline with
+// errors.Is.
+type OfflineError struct {
+	State    string // server.ds_state, eg. "DISCONNECTED"
+	PingPong string // service.pingpong
+}
+
+func (e *OfflineError) Error() string {
+	return fmt.Sprintf("device offline (ds_state=%s, pingpong=%s)", e.State, e.PingPong)
+}
+
+// Is reports whether target is ErrDeviceOffline.
+func (e *OfflineError) Is(target error) bool {
+	return target == ErrDeviceOffline
+}
+
+// PinError is returned when the certificate presented on an IP address
+// route does not match the key pinned for the server. It matches
+// ErrPinMismatch with errors.Is.
+type PinError struct {
+	ServerID string
+	Pin      []byte // pinned SPKI fingerprint
+	Got      []byte // SPKI fingerprint presented
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("certificate for server %s does not match pin (want %x, got %x)", e.ServerID, e.Pin, e.Got)
+}
+
+// Is reports whether target is ErrPinMismatch.
+func (e *PinError) Is(target error) bool {
+	return target == ErrPinMismatch
+}
+
+// BlockedError is returned when connecting to a Record would use an
+// address denied by the Client's AddrPolicy. It matches ErrBlocked with
+// errors.Is.
+type BlockedError struct {
+	Host string // hostname resolved to IP, if any
+	IP   net.IP
+}
+
+func (e *BlockedError) Error() string {
+	if e.Host != "" && e.IP == nil {
+		return fmt.Sprintf("address blocked by policy: %s has no allowed addresses", e.Host)
+	}
+	if e.Host != "" && e.Host != e.IP.String() {
+		return fmt.Sprintf("address blocked by policy: %s (%s)", e.IP, e.Host)
+	}
+	return fmt.Sprintf("address blocked by policy: %s", e.IP)
+}
+
+// Is reports whether target is ErrBlocked.
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// PingErrorKind classifies a PingError.
+type PingErrorKind uint8
+
+const (
+	PingStatus   PingErrorKind = iota + 1 // non-200 HTTP status or "success": false
+	PingContent                           // body not a JSON object of acceptable type and size
+	PingSchema                            // JSON lacking the expected fields
+	PingIdentity                          // ezid does not match the server ID
 )
+
+func (k PingErrorKind) String() string {
+	switch k {
+	case PingStatus:
+		return "status"
+	case PingContent:
+		return "content"
+	case PingSchema:
+		return "schema"
+	case PingIdentity:
+		return "identity"
+	}
+	return fmt.Sprintf("PingErrorKind(%d)", uint8(k))
+}
+
+// PingError is returned when a host answers a ping request but not with
+// a valid ping response. It matches ErrPingFailure with errors.Is.
+type PingError struct {
+	Kind   PingErrorKind
+	Status int   // HTTP status code
+	Err    error // underlying cause, if any
+}
+
+func (e *PingError) Error() string {
+	switch {
+	case e.Kind == PingStatus && e.Err == nil:
+		return fmt.Sprintf("ping response failure: HTTP status %d", e.Status)
+	case e.Kind == PingIdentity:
+		return "ping response failure: ezid does not match server ID"
+	case e.Err != nil:
+		return fmt.Sprintf("ping response failure (%s): %s", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("ping response failure (%s)", e.Kind)
+}
+
+// Is reports whether target is ErrPingFailure.
+func (e *PingError) Is(target error) bool {
+	return target == ErrPingFailure
+}
+
+// Unwrap returns the underlying cause.
+func (e *PingError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,251 @@
+package qcon
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mapping associates a hostname of the device with the IP address of
+// its best verified route, so that clients can connect to the address
+// while verifying the device certificate against the name.
+type Mapping struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	Port int    `json:"port"` // port of the route, for curl --resolve
+}
+
+// Mappings returns a Mapping for each hostname of the device: its FQDN
+// and DDNS names and any names Records were looked up from. Each name is
+// mapped to the highest ranked verified Record with an IP address;
+// tunnel and IPv6 link-local routes are not used. Nil is returned if
+// there is no such Record.
+func Mappings(info *Info) []Mapping {
+
+	var names []string
+
+	seen := make(map[string]bool)
+
+	addName := func(name string) {
+		name = strings.ToLower(name)
+		if name != "" && name != "null" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	addName(info.HTTPS.Server.FQDN)
+	addName(info.HTTPS.Server.DDNS)
+
+	for _, r := range info.Records {
+		addName(r.ServerName)
+	}
+
+	var best *Record
+
+	for i := range info.Records {
+		r := &info.Records[i]
+
+		if r.State != StateOK || isTunnel(r.Type) {
+			continue
+		}
+
+		ip := net.ParseIP(urlHost(r.URL))
+		if ip != nil && !ip.IsLinkLocalUnicast() {
+			best = r
+			break
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	u, _ := url.Parse(best.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	var maps []Mapping
+
+	for _, name := range names {
+		maps = append(maps, Mapping{Name: name, IP: urlHost(best.URL), Port: port})
+	}
+
+	return maps
+}
+
+// HostsLines returns the Mappings of info as lines for a hosts file,
+// such as /etc/hosts.
+func HostsLines(info *Info) []string {
+
+	var lines []string
+
+	for _, m := range Mappings(info) {
+		lines = append(lines, m.IP+"\t"+m.Name)
+	}
+
+	return lines
+}
+
+// CurlResolve returns the Mappings of info as values for curl's
+// --resolve option (host:port:address).
+func CurlResolve(info *Info) []string {
+
+	var args []string
+
+	for _, m := range Mappings(info) {
+		ip := m.IP
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+
+		args = append(args, fmt.Sprintf("%s:%d:%s", m.Name, m.Port, ip))
+	}
+
+	return args
+}
+
+// UpdateHostsFile replaces the block of lines managed for the device
+// with the given QuickConnect ID in the hosts file at path with lines,
+// appending the block if not present and removing it if lines is empty.
+// The block is delimited by "# BEGIN qcon <id>" and "# END qcon <id>"
+// comment lines; the rest of the file is left unchanged, except that
+// any further blocks for the same ID are dropped.
+//
+// The file is replaced atomically by renaming a new file over it, so
+// the new file has the owner (and any security labels) of a file newly
+// created by the caller. Where it cannot be renamed over, as for a
+// bind-mounted /etc/hosts in a container, it is rewritten in place
+// instead, keeping its owner and labels but without the atomicity.
+func UpdateHostsFile(path, id string, lines []string) error {
+
+	id, err := ParseID(id)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+
+	old, err := ioutil.ReadFile(path)
+	if err == nil {
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	begin, end := "# BEGIN qcon "+id, "# END qcon "+id
+
+	var out bytes.Buffer
+	var in, done bool
+
+	block := func() {
+		if len(lines) > 0 {
+			fmt.Fprintln(&out, begin)
+			for _, l := range lines {
+				fmt.Fprintln(&out, l)
+			}
+			fmt.Fprintln(&out, end)
+		}
+		done = true
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(old))
+
+	for sc.Scan() {
+		line := sc.Text()
+
+		switch {
+		case in:
+			if strings.TrimSpace(line) == end {
+				in = false
+			}
+		case strings.TrimSpace(line) == begin:
+			in = true
+			if !done {
+				block()
+			}
+		default:
+			fmt.Fprintln(&out, line)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	if in {
+		return fmt.Errorf("%s: unterminated %q block", path, begin)
+	}
+
+	if !done {
+		block()
+	}
+
+	err = writeAtomic(path, out.Bytes(), mode)
+
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		// eg. a bind mount, which cannot be renamed over
+		return writeInPlace(path, out.Bytes(), mode)
+	}
+
+	return err
+}
+
+// writeAtomic replaces the file at path with data by renaming a
+// temporary file over it, so that a failure cannot leave it partially
+// written. If the rename fails, the file is left unchanged and an
+// *os.LinkError is returned.
+func writeAtomic(path string, data []byte, mode os.FileMode) error {
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// writeInPlace truncates the file at path and writes data to it.
+func writeInPlace(path string, data []byte, mode os.FileMode) error {
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,142 @@
+package qcon
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMappings(t *testing.T) {
+
+	info := &Info{
+		HTTPS: ServerInfo{Server: Server{FQDN: "nas.example.com", DDNS: "MyNAS.synology.me"}},
+		Records: []Record{
+			{URL: "https://[fe80::211:32ff:ef63:bca8%25eth0]:5001", Type: httpsLanIPv6, State: StateOK},
+			{URL: "https://10.20.1.101:5001", Type: httpsLanIPv4, State: StateConnectFailed},
+			{URL: "https://[2001:db8::7]:5001", Type: httpsFQDN, State: StateOK, ServerName: "nas.example.com"},
+			{URL: "https://203.0.113.7:5001", Type: httpsFQDN, State: StateOK, ServerName: "nas.example.com"},
+			{URL: "https://usr5.xxxx.yyyy.quickconnect.to:2905", Type: httpsTunDN, State: StateOK},
+		},
+	}
+
+	exp := []string{"2001:db8::7\tnas.example.com", "2001:db8::7\tmynas.synology.me"}
+	if lines := HostsLines(info); !reflect.DeepEqual(lines, exp) {
+		t.Errorf("unexpected hosts lines:\n  exp: %q\n  got: %q", exp, lines)
+	}
+
+	exp = []string{"nas.example.com:5001:[2001:db8::7]", "mynas.synology.me:5001:[2001:db8::7]"}
+	if args := CurlResolve(info); !reflect.DeepEqual(args, exp) {
+		t.Errorf("unexpected --resolve values:\n  exp: %q\n  got: %q", exp, args)
+	}
+
+	// Only the tunnel remains
+	info.Records = info.Records[4:]
+
+	if m := Mappings(info); m != nil {
+		t.Errorf("expected no mappings, got %v", m)
+	}
+}
+
+func TestUpdateHostsFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qcon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+
+	orig := "127.0.0.1\tlocalhost\n# BEGIN qcon other\n10.0.0.9\tother.example.com\n# END qcon other\n"
+
+	if err := ioutil.WriteFile(path, []byte(orig), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(exp string) {
+		t.Helper()
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != exp {
+			t.Errorf("unexpected hosts file:\n%s\nexpected:\n%s", b, exp)
+		}
+	}
+
+	// added at the end
+	if err := UpdateHostsFile(path, "MyNAS", []string{"10.20.1.100\tnas.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	check(orig + "# BEGIN qcon mynas\n10.20.1.100\tnas.example.com\n# END qcon mynas\n")
+
+	// replaced in place
+	if err := UpdateHostsFile(path, "mynas", []string{"203.0.113.7\tnas.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	check(orig + "# BEGIN qcon mynas\n203.0.113.7\tnas.example.com\n# END qcon mynas\n")
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("file mode not preserved: %v", fi.Mode())
+	}
+
+	// removed
+	if err := UpdateHostsFile(path, "mynas", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check(orig)
+
+	// duplicate blocks are dropped
+	dup := "# BEGIN qcon mynas\n10.0.0.1\tnas.example.com\n# END qcon mynas\n"
+
+	if err := ioutil.WriteFile(path, []byte(orig+dup+dup), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateHostsFile(path, "mynas", []string{"203.0.113.7\tnas.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	check(orig + "# BEGIN qcon mynas\n203.0.113.7\tnas.example.com\n# END qcon mynas\n")
+
+	if err := UpdateHostsFile(path, "bad id!", nil); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID, got %v", err)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qcon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A failed rename is reported, leaving no temporary file behind
+	path := filepath.Join(dir, "pins")
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(path, "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var le *os.LinkError
+	if err := writeAtomic(path, []byte("{}"), 0600); !errors.As(err, &le) {
+		t.Errorf("expected *os.LinkError, got %v", err)
+	}
+
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 1 {
+		t.Errorf("expected only the original file, found %d", len(fis))
+	}
+}
@@ -0,0 +1,214 @@
+package qcon
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RouteClass groups Record types by how the device is reached.
+type RouteClass uint8
+
+const (
+	RouteLAN      RouteClass = iota + 1 // device's own interface address
+	RouteHostname                       // FQDN, DDNS or QuickConnect smart host
+	RouteWAN                            // device's external (router) address
+	RouteTunnel                         // QuickConnect relay
+)
+
+func (rc RouteClass) String() string {
+	switch rc {
+	case RouteLAN:
+		return "lan"
+	case RouteHostname:
+		return "hostname"
+	case RouteWAN:
+		return "wan"
+	case RouteTunnel:
+		return "tunnel"
+	}
+	return "RouteClass(" + strconv.Itoa(int(rc)) + ")"
+}
+
+// routeClass returns the RouteClass of Record type t.
+func routeClass(t uint8) RouteClass {
+
+	switch t {
+	case httpsSmartLanIPv4, httpsSmartLanIPv6, httpsLanIPv4, httpsLanIPv6, httpLanIPv4, httpLanIPv6:
+		return RouteLAN
+	case httpsFQDN, httpsDDNS, httpsSmartHost, httpFQDN, httpDDNS:
+		return RouteHostname
+	case httpsSmartWanIPv6, httpsSmartWanIPv4, httpsWanIPv6, httpsWanIPv4, httpWanIPv6, httpWanIPv4:
+		return RouteWAN
+	}
+
+	return RouteTunnel
+}
+
+// Class returns the RouteClass of r.
+func (r Record) Class() RouteClass {
+	return routeClass(r.Type)
+}
+
+// Host is a verified route to the device reduced to its host, so that
+// services other than DSM (SSH, rsync, SMB, ...) can be reached on it.
+type Host struct {
+	Host   string // IP address, with zone if IPv6 link-local, or hostname
+	Name   string // DNS name of the device on this route, if known
+	Class  RouteClass
+	Record Record // highest ranked verified Record with this host
+}
+
+// Addr returns the network address of port on h, suitable for
+// net.Dial. Tunnel routes relay only the DSM web service, so ErrTunnel
+// is returned for them.
+func (h Host) Addr(port int) (string, error) {
+
+	if h.Class == RouteTunnel {
+		return "", ErrTunnel
+	}
+
+	return net.JoinHostPort(h.Host, strconv.Itoa(port)), nil
+}
+
+// Hosts returns the distinct hosts of the verified Records, in ranked
+// order.
+func (res *Resolution) Hosts() []Host {
+
+	var hosts []Host
+
+	seen := make(map[string]bool)
+
+	for _, r := range res.Records {
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			continue
+		}
+
+		h := Host{Host: u.Hostname(), Name: r.ServerName, Class: routeClass(r.Type), Record: r}
+
+		if seen[h.Host] {
+			continue
+		}
+		seen[h.Host] = true
+
+		if h.Name == "" && net.ParseIP(urlHost(r.URL)) == nil {
+			h.Name = h.Host
+		}
+
+		hosts = append(hosts, h)
+	}
+
+	return hosts
+}
+
+// ResolveHosts is a wrapper to (Client) ResolveHosts() using
+// DefaultClient.
+func ResolveHosts(ctx context.Context, id string, port int) ([]Host, error) {
+
+	c := DefaultClient
+	return c.ResolveHosts(ctx, id, port)
+}
+
+// ResolveHosts resolves the given QuickConnect ID and returns the hosts
+// of the verified routes, in ranked order. If port is not 0, only hosts
+// accepting TCP connections on port within the Client timeout are
+// returned, which excludes tunnel routes; ErrCannotAccess is returned
+// if there are none.
+func (c Client) ResolveHosts(ctx context.Context, id string, port int) ([]Host, error) {
+
+	res, err := c.ResolveDetailed(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := res.Hosts()
+
+	if port == 0 {
+		return hosts, nil
+	}
+
+	return c.CheckHosts(ctx, hosts, port)
+}
+
+// CheckHosts tests TCP connectivity to port on each of hosts and returns
+// those that accept connections, in the same order. Tunnel routes are
+// never returned. Connections are subject to the Client's Policy.
+func (c Client) CheckHosts(ctx context.Context, hosts []Host, port int) ([]Host, error) {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	parent := ctx
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ok := make([]bool, len(hosts))
+
+	var wg sync.WaitGroup
+
+	for i, h := range hosts {
+		addr, err := h.Addr(port)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+
+			conn, err := c.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+				ok[i] = true
+			}
+		}(i, addr)
+	}
+
+	wg.Wait()
+
+	var up []Host
+
+	for i, h := range hosts {
+		if ok[i] {
+			up = append(up, h)
+		}
+	}
+
+	if len(up) == 0 {
+		if parent.Err() != nil {
+			return nil, ErrCancelled
+		}
+		return nil, ErrCannotAccess
+	}
+
+	return up, nil
+}
+
+// DialContext connects to addr on the named network, enforcing the
+// Client's Policy if set. It is intended for connecting to the address
+// of a Host.
+func (c Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	d := &net.Dialer{Timeout: defaultDialTimeout}
+
+	if c.Policy == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	return c.Policy.dialer(d.DialContext, c.Resolver)(ctx, network, addr)
+}
+
+// defaultDialTimeout bounds TCP connection attempts made by DialContext
+// when the context has no earlier deadline.
+const defaultDialTimeout = 30 * time.Second
@@ -0,0 +1,113 @@
+package qcon
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestHosts(t *testing.T) {
+
+	res := &Resolution{
+		Records: []Record{
+			{URL: "https://10.20.1.100:5001", Type: httpsLanIPv4},
+			{URL: "https://[fe80::211:32ff:ef63:bca8%25eth0]:5001", Type: httpsLanIPv6},
+			{URL: "https://203.0.113.7:5001", Type: httpsFQDN, ServerName: "nas.example.com"},
+			{URL: "http://10.20.1.100:5000", Type: httpLanIPv4},
+			{URL: "http://nas.example.com:5000", Type: httpFQDN},
+			{URL: "https://usr5.xxxx.yyyy.quickconnect.to:2905", Type: httpsTunDN},
+		},
+	}
+
+	exp := []struct {
+		host  string
+		name  string
+		class RouteClass
+		addr  string
+	}{
+		{"10.20.1.100", "", RouteLAN, "10.20.1.100:22"},
+		{"fe80::211:32ff:ef63:bca8%eth0", "", RouteLAN, "[fe80::211:32ff:ef63:bca8%eth0]:22"},
+		{"203.0.113.7", "nas.example.com", RouteHostname, "203.0.113.7:22"},
+		{"nas.example.com", "nas.example.com", RouteHostname, "nas.example.com:22"},
+		{"usr5.xxxx.yyyy.quickconnect.to", "usr5.xxxx.yyyy.quickconnect.to", RouteTunnel, ""},
+	}
+
+	hosts := res.Hosts()
+	if len(hosts) != len(exp) {
+		t.Fatalf("expected %d hosts, got %d: %+v", len(exp), len(hosts), hosts)
+	}
+
+	for i, h := range hosts {
+		e := exp[i]
+		if h.Host != e.host || h.Name != e.name || h.Class != e.class {
+			t.Errorf("host %d: expected %s/%s/%s, got %s/%s/%s", i, e.host, e.name, e.class, h.Host, h.Name, h.Class)
+		}
+
+		addr, err := h.Addr(22)
+		if e.addr == "" {
+			if err != ErrTunnel {
+				t.Errorf("%s: expected ErrTunnel, got %v", h.Host, err)
+			}
+		} else if addr != e.addr || err != nil {
+			t.Errorf("%s: expected address %s, got %s (%v)", h.Host, e.addr, addr, err)
+		}
+	}
+}
+
+func TestCheckHosts(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	port, _ := strconv.Atoi(urlPort("tcp://" + ln.Addr().String()))
+
+	// reserve a port with nothing listening
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	hosts := []Host{
+		{Host: "relay.example.com", Class: RouteTunnel},
+		{Host: "127.0.0.1", Class: RouteLAN},
+		{Host: "localhost", Class: RouteHostname},
+	}
+
+	c := Client{}
+
+	up, err := c.CheckHosts(context.Background(), hosts, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(up) != 2 || up[0].Host != "127.0.0.1" || up[1].Host != "localhost" {
+		t.Errorf("unexpected hosts: %+v", up)
+	}
+
+	closedPort, _ := strconv.Atoi(urlPort("tcp://" + closed.Addr().String()))
+
+	if _, err := c.CheckHosts(context.Background(), hosts, closedPort); err != ErrCannotAccess {
+		t.Errorf("expected ErrCannotAccess, got %v", err)
+	}
+
+	c.Policy = PublicOnly()
+
+	if _, err := c.CheckHosts(context.Background(), hosts, port); err != ErrCannotAccess {
+		t.Errorf("expected ErrCannotAccess with policy, got %v", err)
+	}
+}
@@ -1,17 +1,21 @@
 package qcon
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"testing"
 	"time"
 )
 
 const (
 	testServResp    = `[{"command":"get_server_info","env":{"control_host":"usc.quickconnect.to","relay_region":"us"},"errno":0,"server":{"ddns":"NULL","ds_state":"CONNECTED","external":{"ip":"75.66.42.168","ipv6":"::"},"fqdn":"NULL","gateway":"10.20.1.1","interface":[{"ip":"10.20.1.100","ipv6":[{"addr_type":32,"address":"fe80::211:32ff:ef63:bca8","prefix_length":64,"scope":"link"},{"addr_type":0,"address":"fd5e:fa6f:11df::100","prefix_length":64,"scope":"global"},{"addr_type":0,"address":"fd5e:fa6f:11df:0:211:32ff:ef63:bca8","prefix_length":64,"scope":"global"}],"mask":"255.255.255.0","name":"eth0"}],"ipv6_tunnel":[],"serverID":"030344165","tcp_punch_port":0,"udp_punch_port":36810,"version":"24922"},"service":{"port":5001,"ext_port":50551,"pingpong":"DISCONNECTED","pingpong_desc":[]},"version":1},{"command":"get_server_info","env":{"control_host":"usc.quickconnect.to","relay_region":"us"},"errno":0,"server":{"ddns":"NULL","ds_state":"CONNECTED","external":{"ip":"75.66.42.168","ipv6":"::"},"fqdn":"NULL","gateway":"10.20.1.1","interface":[{"ip":"10.20.1.100","ipv6":[{"addr_type":32,"address":"fe80::211:32ff:ef63:bca8","prefix_length":64,"scope":"link"},{"addr_type":0,"address":"fd5e:fa6f:11df::100","prefix_length":64,"scope":"global"},{"addr_type":0,"address":"fd5e:fa6f:11df:0:211:32ff:ef63:bca8","prefix_length":64,"scope":"global"}],"mask":"255.255.255.0","name":"eth0"}],"ipv6_tunnel":[],"serverID":"030344165","tcp_punch_port":0,"udp_punch_port":36810,"version":"24922"},"service":{"port":5000,"ext_port":50550,"pingpong":"DISCONNECTED","pingpong_desc":[]},"version":1}]`
+	testRelay       = `"relay_ip":"89.187.18.191","relay_ipv6":"2b02:9df0:c80d::84","relay_dualstack":"usrds5.xxxx.yyyy.quickconnect.to","relay_dn":"usr5.xxxx.yyyy.quickconnect.to","relay_port":2905,"https_ip":"89.187.18.191","https_port":443`
 	testPingSuccess = `{"success": true,"ezid": "36e618cde8a29a8a8ef945ae21402312"}`
 	testPingFail    = `{"success": false}`
 	testPingInvalid = `{"success": true,"ezid": "00000000000000000000000000000000"}`
@@ -84,3 +88,108 @@ func (t mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	return resp, nil
 }
+
+// roundTripFunc adapts a function to the http.RoundTripper interface.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestPingErrors(t *testing.T) {
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPingSuccess))
+	}))
+	defer other.Close()
+
+	responses := map[string]struct {
+		ctype string
+		body  string
+	}{
+		"ok":       {"application/json", testPingSuccess},
+		"extra":    {"text/plain", `{"boot_done": true, "success": true, "ezid": "36e618cde8a29a8a8ef945ae21402312"}`},
+		"fail":     {"application/json", testPingFail},
+		"wrong":    {"application/json", testPingInvalid},
+		"html":     {"text/html", testPingSuccess},
+		"large":    {"application/json", testPingSuccess + strings.Repeat(" ", maxPongSize)},
+		"trailing": {"application/json", testPingSuccess + "{}"},
+		"noezid":   {"application/json", `{"success": true}`},
+		"badezid":  {"application/json", `{"success": true, "ezid": "../../etc/passwd"}`},
+		"numezid":  {"application/json", `{"success": true, "ezid": 42}`},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Split(r.URL.Path, "/")[1]
+
+		switch name {
+		case "local":
+			http.Redirect(w, r, "/ok"+pingPath, http.StatusFound)
+			return
+		case "remote":
+			http.Redirect(w, r, other.URL+pingPath, http.StatusFound)
+			return
+		}
+
+		resp, ok := responses[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", resp.ctype)
+		w.Write([]byte(resp.body))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		kind PingErrorKind // 0 for success
+	}{
+		{"ok", 0},
+		{"extra", 0},
+		{"local", 0},
+		{"remote", PingStatus},
+		{"missing", PingStatus},
+		{"fail", PingStatus},
+		{"wrong", PingIdentity},
+		{"html", PingContent},
+		{"large", PingContent},
+		{"trailing", PingContent},
+		{"noezid", PingSchema},
+		{"badezid", PingSchema},
+		{"numezid", PingSchema},
+	}
+
+	c := Client{}
+
+	for _, tc := range tests {
+		_, _, err := c.ping(context.Background(), Record{URL: srv.URL + "/" + tc.name}, testServerID)
+
+		if tc.kind == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err)
+			}
+			continue
+		}
+
+		var pe *PingError
+		if !errors.As(err, &pe) || pe.Kind != tc.kind || !errors.Is(err, ErrPingFailure) {
+			t.Errorf("%s: expected %s error, got %v", tc.name, tc.kind, err)
+		}
+	}
+
+	if s, _ := c.probe(context.Background(), testServerID, Record{URL: srv.URL + "/wrong"}); s != StateInvalidServer {
+		t.Errorf("expected StateInvalidServer, got %d", s)
+	}
+
+	// Without a server ID to check against, probing fails closed
+	if s, err := c.probe(context.Background(), "", Record{URL: srv.URL + "/ok"}); s != StateInvalidServer || !errors.Is(err, ErrPingFailure) {
+		t.Errorf("expected StateInvalidServer for empty server ID, got %d (%v)", s, err)
+	}
+
+	// but Ping leaves checking the hash to the caller
+	if hash, err := c.Ping(context.Background(), srv.URL+"/ok"); err != nil || !verifyID(testServerID, hash) {
+		t.Errorf("unexpected Ping result %q: %v", hash, err)
+	}
+}
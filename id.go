@@ -0,0 +1,71 @@
+package qcon
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ParseID validates a QuickConnect ID and returns it in its normalized,
+// lower case form. Besides a bare ID it accepts the forms commonly
+// copied from a browser, such as "quickconnect.to/myid",
+// "https://myid.quickconnect.to" or "http://QuickConnect.to/myid/".
+//
+// IDs are used as DNS labels under quickconnect.to, so must be 1 to 63
+// letters, digits or hyphens and may not start or end with a hyphen.
+// ErrInvalidID is returned for anything else.
+func ParseID(s string) (string, error) {
+
+	s = strings.TrimSpace(s)
+
+	if strings.ContainsAny(s, "./:") {
+		if !strings.Contains(s, "://") {
+			s = "http://" + s
+		}
+
+		u, err := url.Parse(s)
+		if err != nil || u.User != nil || u.Port() != "" {
+			return "", ErrInvalidID
+		}
+
+		host := strings.ToLower(u.Hostname())
+		path := strings.Trim(u.Path, "/")
+
+		switch {
+		case host == "quickconnect.to" || host == "www.quickconnect.to":
+			// ID is the first path element
+			s = strings.SplitN(path, "/", 2)[0]
+
+		case strings.HasSuffix(host, ".quickconnect.to") && path == "":
+			// ID is the first label, possibly followed by a region
+			s = strings.SplitN(host, ".", 2)[0]
+
+		default:
+			return "", ErrInvalidID
+		}
+	}
+
+	s = strings.ToLower(s)
+
+	if !validID(s) {
+		return "", ErrInvalidID
+	}
+
+	return s, nil
+}
+
+// validID reports whether s is a syntactically valid, lower case
+// QuickConnect ID.
+func validID(s string) bool {
+
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,172 @@
+package qcon
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseID(t *testing.T) {
+
+	tests := []struct {
+		in  string
+		exp string
+		err error
+	}{
+		{"myid", "myid", nil},
+		{" MyID-2 ", "myid-2", nil},
+		{"quickconnect.to/myid", "myid", nil},
+		{"https://myid.quickconnect.to", "myid", nil},
+		{"https://myid.quickconnect.to/", "myid", nil},
+		{"myid.de3.quickconnect.to", "myid", nil},
+		{"http://QuickConnect.to/myid/", "myid", nil},
+		{"https://www.quickconnect.to/MyID", "myid", nil},
+		{"", "", ErrInvalidID},
+		{"my\"id", "", ErrInvalidID},
+		{"my id", "", ErrInvalidID},
+		{"-myid", "", ErrInvalidID},
+		{"myid-", "", ErrInvalidID},
+		{"quickconnect.to/", "", ErrInvalidID},
+		{"https://example.com/myid", "", ErrInvalidID},
+		{"https://myid.quickconnect.to:5001", "", ErrInvalidID},
+		{"https://myid.quickconnect.to/sharing/abc", "", ErrInvalidID},
+		{"abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyzabcdefghijkl", "", ErrInvalidID},
+	}
+
+	for _, tc := range tests {
+		id, err := ParseID(tc.in)
+		if err != tc.err {
+			t.Errorf("%q: unexpected error: exp %v, got %v", tc.in, tc.err, err)
+			continue
+		}
+
+		if id != tc.exp {
+			t.Errorf("%q: unexpected ID: exp %q, got %q", tc.in, tc.exp, id)
+		}
+	}
+}
+
+func TestResolveInvalidID(t *testing.T) {
+
+	// Fails before any request is made
+	_, err := Resolve(context.Background(), `foo", "command": "request_tunnel`)
+	if err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID, got %v", err)
+	}
+}
+
+func TestParseShareLink(t *testing.T) {
+
+	tests := []struct {
+		in  string
+		exp ShareLink
+		err error
+	}{
+		{"https://gofile.me/6Vab1/Xyz_9-q", ShareLink{ID: "6Vab1", SharingID: "Xyz_9-q", Gofile: true}, nil},
+		{"gofile.me/6Vab1/Xyz9q/", ShareLink{ID: "6Vab1", SharingID: "Xyz9q", Gofile: true}, nil},
+		{"https://MyID.quickconnect.to/sharing/AbC123", ShareLink{ID: "myid", SharingID: "AbC123"}, nil},
+		{"http://QuickConnect.to/myid/sharing/AbC123", ShareLink{ID: "myid", SharingID: "AbC123"}, nil},
+		{"https://gofile.me/6Vab1", ShareLink{}, ErrInvalidShareLink},
+		{"https://gofile.me/6V\"b1/Xyz9q", ShareLink{}, ErrInvalidShareLink},
+		{"https://myid.quickconnect.to/AbC123", ShareLink{}, ErrInvalidShareLink},
+		{"https://example.com/sharing/AbC123", ShareLink{}, ErrInvalidShareLink},
+		{"https://-bad.quickconnect.to/sharing/AbC123", ShareLink{}, ErrInvalidShareLink},
+	}
+
+	for _, tc := range tests {
+		l, err := ParseShareLink(tc.in)
+		if err != tc.err {
+			t.Errorf("%q: unexpected error: exp %v, got %v", tc.in, tc.err, err)
+			continue
+		}
+
+		if l != tc.exp {
+			t.Errorf("%q: unexpected link: exp %+v, got %+v", tc.in, tc.exp, l)
+		}
+	}
+}
+
+func TestResolveShareLink(t *testing.T) {
+
+	var host string
+
+	nas := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/webman/pingpong.cgi":
+			fmt.Fprintf(w, `{"success": true, "ezid": "%x"}`, md5.Sum([]byte(testServerID)))
+		case r.URL.Path == "/sharing/webapi/entry.cgi" && r.FormValue("api") == "SYNO.FolderSharing.Download" &&
+			r.FormValue("method") == "download" && r.FormValue("_sharing_id") == `"Xyz9q"`:
+			host = r.Host
+			w.Header().Set("Content-Disposition", `attachment; filename="report.pdf"`)
+			fmt.Fprint(w, "shared file contents")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer nas.Close()
+
+	port, _ := strconv.Atoi(urlPort(nas.URL))
+
+	var gofile bool
+
+	// The device is reached by LAN IP, with its certificate valid for its FQDN
+	si := ServerInfo{
+		Server: Server{
+			ServerID:  testServerID,
+			FQDN:      "example.com",
+			DDNS:      "NULL",
+			DSState:   "CONNECTED",
+			Interface: []Interface{{Name: "lo", IP: "127.0.0.1", Mask: "255.0.0.0"}},
+		},
+		Service: Service{Port: port},
+	}
+
+	ctrl := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []Request
+		json.NewDecoder(r.Body).Decode(&reqs)
+		gofile = len(reqs) > 0 && reqs[0].IsGofile && reqs[0].ServerID == "6Vab1"
+		json.NewEncoder(w).Encode([]ServerInfo{si, si})
+	}))
+	defer ctrl.Close()
+
+	c := tlsClient(nas)
+	c.servURL = ctrl.URL
+	c.Timeout = 200 * time.Millisecond
+
+	item, err := c.ResolveShareLink(context.Background(), "https://gofile.me/6Vab1/Xyz9q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !gofile {
+		t.Error("request not sent with is_gofile and gofile ID")
+	}
+
+	if item.Record.URL != "https://127.0.0.1:"+strconv.Itoa(port) || !strings.HasPrefix(item.URL, item.Record.URL+"/sharing/webapi/entry.cgi?") {
+		t.Errorf("unexpected download URL %s on route %s", item.URL, item.Record.URL)
+	}
+
+	resp, err := item.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != "shared file contents" {
+		t.Errorf("unexpected download response %d %q", resp.StatusCode, body)
+	}
+
+	if host != "example.com:"+strconv.Itoa(port) {
+		t.Errorf("download sent with Host %q", host)
+	}
+}
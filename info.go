@@ -3,6 +3,8 @@ package qcon
 import (
 	"net"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 // TODO: change const to allow bitmap operations
@@ -28,24 +30,66 @@ const (
 	httpDDNS
 	httpWanIPv6
 	httpWanIPv4
+	httpsTunDualStack // relay hostnames carry valid certificates, so
+	httpsTunDN        // are preferred over relay IP addresses
 	httpsTun
+	httpsTunHTTPS
 	httpTun
 	maxRecordType
 )
 
 func isHTTPS(t uint8) bool {
-	return t < httpLanIPv4 || t == httpsTun
+	return t < httpLanIPv4 || (t >= httpsTunDualStack && t < httpTun)
+}
+
+func isTunnel(t uint8) bool {
+	return t >= httpsTunDualStack && t < maxRecordType
 }
 
 // Record is a single QuickConnect redirect record indicating a
 // URL that may be able to access the desired Synology service.
 // Each record has a Type which is used to prioritize URLs and
 // a State to indicate the result of the most recent connection
-// test with that host.
+// test with that host. Sources lists every field of the server
+// response that produced the URL. If the URL host is an address
+// looked up from a hostname, ServerName holds that hostname for use
+// in TLS verification and the Host header. Err holds the reason the
+// most recent test failed, if it did.
 type Record struct {
-	URL   string
-	Type  uint8
-	State ConnState
+	URL        string
+	Type       uint8
+	State      ConnState
+	Sources    Source
+	ServerName string
+	Err        error
+}
+
+// Source is a bitmap of the server info fields a Record URL was
+// derived from.
+type Source uint8
+
+const (
+	SourceInterface Source = 1 << iota
+	SourceExternal
+	SourceDDNS
+	SourceFQDN
+	SourceSmartDNS
+	SourceRelay
+)
+
+var sourceNames = []string{"interface", "external", "ddns", "fqdn", "smartdns", "relay"}
+
+func (s Source) String() string {
+
+	var names []string
+
+	for i, n := range sourceNames {
+		if s&(1<<uint(i)) != 0 {
+			names = append(names, n)
+		}
+	}
+
+	return strings.Join(names, "|")
 }
 
 // ConnState indicates the connection state with a URL/host
@@ -56,19 +100,102 @@ const (
 	StateOK
 	StateConnectFailed
 	StateInvalidServer
+	StatePinMismatch
+	StateUntrustedTLS // answered correctly, but over an unauthenticated connection
+	StateBlocked      // not attempted, address denied by Client.Policy
 )
 
-// Info contains information about a QuickConnect host
+var stateNames = []string{"unknown", "ok", "connect-failed", "invalid-server", "pin-mismatch", "untrusted-tls", "blocked"}
+
+func (s ConnState) String() string {
+
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+
+	return "ConnState(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Skipped describes a candidate address that could not be turned
+// into a Record, along with the reason it was dropped.
+type Skipped struct {
+	Address string
+	Type    uint8
+	Reason  error
+}
+
+// Info contains information about a QuickConnect host. ID is the
+// QuickConnect ID it was retrieved for. HTTPS and HTTP hold the decoded
+// server responses for the two DSM portals.
 type Info struct {
+	ID       string
 	ServerID string
 	Records  []Record
+	Skipped  []Skipped
+	HTTPS    ServerInfo
+	HTTP     ServerInfo
+	gofile   bool // ID is a gofile.me share link ID
+}
+
+// addRecords adds Records of every type found in the HTTPS and HTTP
+// server responses of set, using zones for link-local addresses.
+func (set *Info) addRecords(zones []string) {
+
+	for t := uint8(0); t < maxRecordType; t++ {
+		recs, skipped := getRecords(set.serverInfo(t), t, zones)
+
+		for _, r := range recs {
+			set.add(r)
+		}
+
+		set.Skipped = append(set.Skipped, skipped...)
+	}
+}
+
+// serverInfo returns the server response Records of type t are built
+// from.
+func (set *Info) serverInfo(t uint8) ServerInfo {
+
+	if isHTTPS(t) {
+		return set.HTTPS
+	}
+
+	return set.HTTP
 }
 
-// Add Record to Info, sorted by Record.Type
+// Add Record to Info, sorted by Record.Type. If a Record with the
+// same URL already exists the two are merged, keeping the higher
+// priority Type, its ServerName (unless empty) and the union of their
+// Sources.
 func (set *Info) add(r Record) {
 
 	s := set.Records
 
+	for i := range s {
+		if s[i].URL != r.URL {
+			continue
+		}
+
+		r.Sources |= s[i].Sources
+
+		if r.ServerName == "" {
+			r.ServerName = s[i].ServerName
+		}
+
+		if s[i].Type <= r.Type {
+			s[i].Sources = r.Sources
+			if s[i].ServerName == "" {
+				s[i].ServerName = r.ServerName
+			}
+			return
+		}
+
+		// new record takes priority; remove the existing one and
+		// insert below
+		s = append(s[:i], s[i+1:]...)
+		break
+	}
+
 	// Find insertion point
 	i := sort.Search(len(s), func(i int) bool { return s[i].Type >= r.Type })
 
@@ -104,3 +231,38 @@ func isLocalIP(addr string) bool {
 
 	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
 }
+
+// interfaceZones returns the names of local network interfaces that are
+// up and have an IPv6 link-local address, and so can be used as the zone
+// for reaching link-local addresses on the server. It is a variable so
+// tests can substitute a fixed set of interfaces.
+var interfaceZones = func() []string {
+
+	ifcs, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var zones []string
+
+	for _, ifc := range ifcs {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if ok && ipn.IP.To4() == nil && ipn.IP.IsLinkLocalUnicast() {
+				zones = append(zones, ifc.Name)
+				break
+			}
+		}
+	}
+
+	return zones
+}
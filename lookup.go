@@ -0,0 +1,122 @@
+package qcon
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// HostResolver looks up the IP addresses of a hostname. It is satisfied
+// by *net.Resolver, so net.DefaultResolver or the result of
+// NewDNSResolver may be used directly.
+type HostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewDNSResolver returns a resolver that sends all queries to the DNS
+// server at addr (in host:port form) rather than the servers configured
+// on the system.
+func NewDNSResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// expandHosts replaces FQDN and DDNS Records in info with one Record per
+// address returned by c.Resolver. The new Records keep the hostname in
+// ServerName so TLS verification and the Host header still use it. If a
+// name cannot be resolved its original Record is kept.
+func (c Client) expandHosts(ctx context.Context, info *Info) {
+
+	lookups := make(map[string][]net.IPAddr)
+	out := make([]Record, 0, len(info.Records))
+
+	for _, r := range info.Records {
+		u, err := url.Parse(r.URL)
+		if err != nil || r.Sources&(SourceFQDN|SourceDDNS) == 0 || net.ParseIP(u.Hostname()) != nil {
+			out = append(out, r)
+			continue
+		}
+
+		host := u.Hostname()
+
+		addrs, ok := lookups[host]
+		if !ok {
+			addrs, err = c.Resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				addrs = nil
+			}
+			lookups[host] = interleave(addrs)
+			addrs = lookups[host]
+		}
+
+		if len(addrs) == 0 {
+			out = append(out, r)
+			continue
+		}
+
+		for _, a := range addrs {
+			e := r
+			e.URL = (&url.URL{Scheme: u.Scheme, Host: net.JoinHostPort(a.String(), u.Port())}).String()
+			e.ServerName = host
+			out = append(out, e)
+		}
+	}
+
+	// Records of equal Type are inserted ahead of each other, so add in
+	// reverse to keep the order built above.
+	info.Records = make([]Record, 0, len(out))
+	for i := len(out) - 1; i >= 0; i-- {
+		info.add(out[i])
+	}
+}
+
+// interleave orders addresses alternating between IPv6 and IPv4, starting
+// with IPv6, as recommended by RFC 8305 so that a broken address family
+// does not hold up every attempt.
+func interleave(addrs []net.IPAddr) []net.IPAddr {
+
+	var v4, v6 []net.IPAddr
+
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+
+	out := make([]net.IPAddr, 0, len(addrs))
+
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+
+	return out
+}
+
+// hostHeader returns the Host header value for a request to name on the
+// port used by rawURL.
+func hostHeader(rawURL, name string) string {
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Port() == "" {
+		return name
+	}
+
+	if p, _ := strconv.Atoi(u.Port()); (u.Scheme == "https" && p == 443) || (u.Scheme == "http" && p == 80) {
+		return name
+	}
+
+	return net.JoinHostPort(name, u.Port())
+}
@@ -0,0 +1,249 @@
+package qcon
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultMonitorInterval is how often a Monitor resolves devices again
+// if Monitor.Interval is not set.
+const DefaultMonitorInterval = time.Minute
+
+// RouteChange reports a change in the best route to a device watched by
+// a Monitor. URL is empty and Err set while the device cannot be
+// resolved.
+type RouteChange struct {
+	ID      string
+	Time    time.Time
+	URL     string // new best URL
+	Prev    string // previous best URL
+	Err     error
+	Res     *Resolution // nil if resolution failed before testing routes
+	Initial bool        // first resolution since the device was watched
+}
+
+// Monitor resolves a set of devices periodically through a Cache,
+// keeping it fresh, and notifies subscribers when the best route to a
+// device changes.
+type Monitor struct {
+	Cache    *Cache
+	Interval time.Duration // DefaultMonitorInterval if zero
+
+	mu      sync.Mutex
+	watched map[string]*watchState
+	subs    map[chan RouteChange]struct{}
+	wake    chan struct{}
+}
+
+type watchState struct {
+	url  string
+	err  error
+	seen bool
+}
+
+// subscriberBuffer is the number of changes buffered per subscriber;
+// further changes are dropped until the subscriber catches up.
+const subscriberBuffer = 16
+
+// NewMonitor returns a Monitor resolving through cache.
+func NewMonitor(cache *Cache) *Monitor {
+	return &Monitor{Cache: cache}
+}
+
+// Watch adds the device with the given QuickConnect ID to those
+// monitored, resolving it as soon as Run is able to.
+func (m *Monitor) Watch(id string) error {
+
+	id, err := ParseID(id)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+
+	if _, ok := m.watched[id]; ok {
+		return nil
+	}
+
+	m.watched[id] = &watchState{}
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Unwatch stops monitoring the device with the given QuickConnect ID.
+func (m *Monitor) Unwatch(id string) {
+
+	id, err := ParseID(id)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.watched, id)
+}
+
+// Watched returns the IDs of the monitored devices.
+func (m *Monitor) Watched() []string {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.watched))
+
+	for id := range m.watched {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Subscribe returns a channel receiving RouteChanges, and a function to
+// call to stop receiving them. Changes are dropped if the channel is
+// not read promptly.
+func (m *Monitor) Subscribe() (<-chan RouteChange, func()) {
+
+	ch := make(chan RouteChange, subscriberBuffer)
+
+	m.mu.Lock()
+	m.init()
+	m.subs[ch] = struct{}{}
+	m.mu.Unlock()
+
+	return ch, func() {
+		m.mu.Lock()
+		delete(m.subs, ch)
+		m.mu.Unlock()
+	}
+}
+
+// Run monitors the watched devices until ctx is done. Devices are
+// resolved bypassing the cache every Interval, and newly watched devices
+// immediately.
+func (m *Monitor) Run(ctx context.Context) error {
+
+	m.mu.Lock()
+	m.init()
+	m.mu.Unlock()
+
+	interval := m.Interval
+	if interval <= 0 {
+		interval = DefaultMonitorInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-ticker.C:
+			m.check(ctx, true)
+
+		case <-m.wake:
+			m.check(ctx, false)
+		}
+	}
+}
+
+// check resolves the watched devices, or only those not yet resolved
+// unless all is set, and publishes changes.
+func (m *Monitor) check(ctx context.Context, all bool) {
+
+	m.mu.Lock()
+
+	var ids []string
+
+	for id, ws := range m.watched {
+		if all || !ws.seen {
+			ids = append(ids, id)
+		}
+	}
+
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			if all {
+				m.Cache.Invalidate(id)
+			}
+
+			res, _, err := m.Cache.Resolve(ctx, id)
+			if err == ErrCancelled {
+				return
+			}
+
+			m.update(id, res, err)
+		}(id)
+	}
+
+	wg.Wait()
+}
+
+// update records the outcome of resolving id and publishes a
+// RouteChange if the best URL changed.
+func (m *Monitor) update(id string, res *Resolution, err error) {
+
+	var url string
+
+	if err == nil {
+		url = res.Best.URL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ws, ok := m.watched[id]
+	if !ok {
+		return
+	}
+
+	if ws.seen && ws.url == url && (ws.err == nil) == (err == nil) {
+		return
+	}
+
+	change := RouteChange{
+		ID:      id,
+		Time:    time.Now(),
+		URL:     url,
+		Prev:    ws.url,
+		Err:     err,
+		Res:     res,
+		Initial: !ws.seen,
+	}
+
+	ws.url, ws.err, ws.seen = url, err, true
+
+	for ch := range m.subs {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+func (m *Monitor) init() {
+
+	if m.watched == nil {
+		m.watched = make(map[string]*watchState)
+		m.subs = make(map[chan RouteChange]struct{})
+		m.wake = make(chan struct{}, 1)
+	}
+}
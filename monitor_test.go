@@ -0,0 +1,91 @@
+package qcon
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+
+	defer setZones()()
+
+	lan := &mockTransport{
+		responses: map[string]response{
+			defaultServURL:                        {Status: 200, Body: testServResp},
+			"https://10.20.1.100:5001" + pingPath: {Status: 200, Body: testPingSuccess},
+		},
+	}
+
+	wan := &mockTransport{
+		responses: map[string]response{
+			defaultServURL:                         {Status: 200, Body: testServResp},
+			"https://75.66.42.168:5001" + pingPath: {Status: 200, Body: testPingSuccess},
+		},
+	}
+
+	var current atomic.Value
+	current.Store(lan)
+
+	c := &Client{
+		Client: &http.Client{
+			Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return current.Load().(*mockTransport).RoundTrip(req)
+			}),
+		},
+		Timeout: 20 * time.Millisecond,
+	}
+
+	m := NewMonitor(NewCache(c))
+	m.Interval = 50 * time.Millisecond
+
+	changes, stop := m.Subscribe()
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go m.Run(ctx)
+
+	if err := m.Watch("FOO"); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() RouteChange {
+		t.Helper()
+		select {
+		case rc := <-changes:
+			return rc
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for route change")
+		}
+		return RouteChange{}
+	}
+
+	rc := next()
+	if rc.ID != "foo" || !rc.Initial || rc.URL != "https://10.20.1.100:5001" || rc.Err != nil || rc.Res == nil {
+		t.Errorf("unexpected initial change: %+v", rc)
+	}
+
+	// The device moves networks
+	current.Store(wan)
+
+	rc = next()
+	if rc.Initial || rc.URL != "https://75.66.42.168:5001" || rc.Prev != "https://10.20.1.100:5001" {
+		t.Errorf("unexpected change: %+v", rc)
+	}
+
+	if ids := m.Watched(); len(ids) != 1 || ids[0] != "foo" {
+		t.Errorf("unexpected watched IDs: %v", ids)
+	}
+
+	// ...and goes away
+	current.Store(&mockTransport{responses: map[string]response{defaultServURL: {Status: 200, Body: testServResp}}})
+
+	rc = next()
+	if rc.URL != "" || rc.Err != ErrCannotAccess || rc.Prev != "https://75.66.42.168:5001" {
+		t.Errorf("unexpected change: %+v", rc)
+	}
+}
@@ -0,0 +1,231 @@
+package qcon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+)
+
+// PinStore holds certificate pins, keyed by server ID (Info.ServerID).
+// A pin is the SHA-256 hash of a certificate's SubjectPublicKeyInfo.
+//
+// When Client.Pins is set, the certificate of a device reached over a
+// route whose certificate is verified against a hostname (FQDN, DDNS or
+// a looked up address with Record.ServerName) is pinned. HTTPS routes to
+// IP addresses, which cannot have their certificate verified against a
+// name, are then accepted only if they present the pinned key, and fail
+// with a *PinError otherwise. Routes to IP addresses of a server with no
+// pin yet are verified as usual by the Client's transport.
+//
+// Pins are only applied if the Client's transport is an *http.Transport
+// (or nil).
+type PinStore interface {
+	// GetPin returns the pin for serverID, or nil if there is none.
+	GetPin(serverID string) ([]byte, error)
+
+	// SetPin stores the pin for serverID, replacing any existing one.
+	SetPin(serverID string, pin []byte) error
+}
+
+// MemoryPinStore is a PinStore held in memory. The zero value is an
+// empty store ready to use.
+type MemoryPinStore struct {
+	mu   sync.Mutex
+	pins map[string][]byte
+}
+
+// GetPin implements PinStore.
+func (s *MemoryPinStore) GetPin(serverID string) ([]byte, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pins[serverID], nil
+}
+
+// SetPin implements PinStore.
+func (s *MemoryPinStore) SetPin(serverID string, pin []byte) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pins == nil {
+		s.pins = make(map[string][]byte)
+	}
+
+	s.pins[serverID] = pin
+
+	return nil
+}
+
+// FilePinStore is a PinStore saved as a JSON object in the file at Path,
+// which is created when the first pin is stored.
+type FilePinStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// GetPin implements PinStore.
+func (s *FilePinStore) GetPin(serverID string) ([]byte, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return pins[serverID], nil
+}
+
+// SetPin implements PinStore.
+func (s *FilePinStore) SetPin(serverID string, pin []byte) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	pins[serverID] = pin
+
+	b, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write atomically so a failure cannot lose existing pins
+	return writeAtomic(s.Path, b, 0600)
+}
+
+func (s *FilePinStore) load() (map[string][]byte, error) {
+
+	pins := make(map[string][]byte)
+
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &pins)
+	if err != nil {
+		return nil, err
+	}
+
+	return pins, nil
+}
+
+// spkiPin returns the pin of a DER encoded certificate.
+func spkiPin(der []byte) ([]byte, error) {
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return certPin(cert), nil
+}
+
+// certPin returns the pin of cert.
+func certPin(cert *x509.Certificate) []byte {
+
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return sum[:]
+}
+
+// pinTLS sets up cfg to record or check the pin of the server with the
+// given ID when pinging r.
+func (c Client) pinTLS(cfg *tls.Config, r Record, serverID string) {
+
+	verify := cfg.VerifyPeerCertificate
+
+	switch {
+	case isNameRoute(r):
+		// Verified against a name as usual, then pinned
+		cfg.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			if verify != nil {
+				if err := verify(raw, chains); err != nil {
+					return err
+				}
+			}
+
+			if len(raw) == 0 || len(chains) == 0 {
+				return nil
+			}
+
+			pin, err := spkiPin(raw[0])
+			if err != nil {
+				return err
+			}
+
+			// Failing to store a pin doesn't make the route insecure
+			c.Pins.SetPin(serverID, pin)
+
+			return nil
+		}
+
+	case isIPRoute(r):
+		pin, err := c.Pins.GetPin(serverID)
+		if err != nil || pin == nil {
+			return
+		}
+
+		// The pin replaces verification against a name, which can't
+		// succeed for an IP address
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("no certificate presented")
+			}
+
+			got, err := spkiPin(raw[0])
+			if err != nil {
+				return err
+			}
+
+			if !bytes.Equal(got, pin) {
+				return &PinError{ServerID: serverID, Pin: pin, Got: got}
+			}
+
+			if verify != nil {
+				return verify(raw, chains)
+			}
+
+			return nil
+		}
+	}
+}
+
+// isNameRoute reports whether r is verified against a hostname of the
+// device itself. Relay hostnames carry the relay's certificate and are
+// excluded.
+func isNameRoute(r Record) bool {
+
+	if isTunnel(r.Type) {
+		return false
+	}
+
+	return r.ServerName != "" || net.ParseIP(urlHost(r.URL)) == nil
+}
+
+// isIPRoute reports whether r connects to an IP address with no
+// hostname to verify against.
+func isIPRoute(r Record) bool {
+	return r.ServerName == "" && net.ParseIP(urlHost(r.URL)) != nil
+}
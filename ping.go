@@ -1,58 +1,340 @@
 package qcon
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"strings"
 )
 
 const pingPath = "/webman/pingpong.cgi?action=cors&quickconnect=true"
 
 // Ping attempts a ping-pong request to the given URL and returns
 // an MD5 hash of the ServerID from the response for use in verification.
+// The hash is not checked against any server ID; that is left to the
+// caller. Failures of the endpoint to answer correctly are reported as a
+// *PingError.
 func (c Client) Ping(ctx context.Context, url string) (string, error) {
+	hash, _, _, err := c.pong(ctx, Record{URL: url}, "")
+	return hash, err
+}
+
+// ping performs Ping for the URL of r, a Record of the server with the
+// given ID, also returning the TLS state of the connection if any. The
+// reply must match serverID, so a ping for an unknown (empty) server ID
+// always fails with a PingIdentity error.
+func (c Client) ping(ctx context.Context, r Record, serverID string) (string, *tls.ConnectionState, error) {
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+pingPath, nil)
+	hash, cs, status, err := c.pong(ctx, r, serverID)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	httpClient := c.Client
-	if httpClient == nil {
-		httpClient = &http.Client{}
+	if !verifyID(serverID, hash) {
+		return "", nil, &PingError{Kind: PingIdentity, Status: status}
 	}
 
-	resp, err := httpClient.Do(req)
+	return hash, cs, nil
+}
+
+// pong sends a ping request for the URL of r and returns the ezid of the
+// reply along with the TLS state of the connection and the HTTP status.
+// If r.ServerName is set it is sent as the Host header and used as the
+// TLS server name. serverID selects the pinned key, if any.
+func (c Client) pong(ctx context.Context, r Record, serverID string) (string, *tls.ConnectionState, int, error) {
+
+	if c.Policy != nil {
+		if err := c.Policy.checkURL(r.URL); err != nil {
+			return "", nil, 0, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL+pingPath, nil)
 	if err != nil {
-		return "", err
+		return "", nil, 0, err
+	}
+
+	if r.ServerName != "" {
+		req.Host = hostHeader(r.URL, r.ServerName)
+	}
+
+	httpClient, done := c.probeClient(r, serverID)
+	defer done()
+
+	hc := *httpClient
+	hc.CheckRedirect = sameHostRedirect
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", nil, 0, err
 	}
 	defer resp.Body.Close()
 
+	hash, err := readPong(resp)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	return hash, resp.TLS, resp.StatusCode, nil
+}
+
+// maxPongSize limits the size of a ping response body; genuine
+// responses are well under 100 bytes.
+const maxPongSize = 4096
+
+// readPong validates a ping response and returns its ezid. The body
+// must be a single JSON object with "success": true and an "ezid" of
+// 32 hex digits. Other fields (such as "boot_done") are ignored.
+func readPong(resp *http.Response) (string, error) {
+
 	if resp.StatusCode != http.StatusOK {
-		return "", ErrPingFailure
+		return "", &PingError{Kind: PingStatus, Status: resp.StatusCode}
 	}
 
-	var jsonResp struct {
-		Success bool
-		EZID    string
+	fail := func(kind PingErrorKind, err error) (string, error) {
+		return "", &PingError{Kind: kind, Status: resp.StatusCode, Err: err}
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&jsonResp)
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return fail(PingContent, err)
+		}
+
+		switch mt {
+		case "application/json", "text/json", "text/plain", "text/javascript", "application/javascript":
+		default:
+			return fail(PingContent, fmt.Errorf("unexpected content type %q", mt))
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPongSize+1))
 	if err != nil {
-		return "", err
+		return fail(PingContent, err)
+	}
+
+	if len(body) > maxPongSize {
+		return fail(PingContent, fmt.Errorf("response exceeds %d bytes", maxPongSize))
 	}
 
-	if !jsonResp.Success {
-		return "", ErrPingFailure
+	var pong struct {
+		Success *bool   `json:"success"`
+		EZID    *string `json:"ezid"`
 	}
 
-	return jsonResp.EZID, nil
+	dec := json.NewDecoder(bytes.NewReader(body))
+
+	if err := dec.Decode(&pong); err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			return fail(PingSchema, err)
+		}
+		return fail(PingContent, err)
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return fail(PingContent, errors.New("trailing data after JSON object"))
+	}
+
+	if pong.Success == nil {
+		return fail(PingSchema, errors.New(`missing "success"`))
+	}
+
+	if !*pong.Success {
+		return fail(PingStatus, errors.New(`"success": false`))
+	}
+
+	if pong.EZID == nil {
+		return fail(PingSchema, errors.New(`missing "ezid"`))
+	}
+
+	if !validEZID(*pong.EZID) {
+		return fail(PingSchema, fmt.Errorf("malformed ezid %q", *pong.EZID))
+	}
+
+	return *pong.EZID, nil
+}
+
+// validEZID reports whether s is a hex encoded MD5 hash.
+func validEZID(s string) bool {
+
+	if len(s) != 2*md5.Size {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+
+	return err == nil
+}
+
+// sameHostRedirect is the CheckRedirect policy for pings: redirects are
+// only followed within the same host and port, otherwise the redirect
+// response itself is returned (and rejected as a ping failure).
+func sameHostRedirect(req *http.Request, via []*http.Request) error {
+
+	if len(via) >= 3 || req.URL.Host != via[0].URL.Host {
+		return http.ErrUseLastResponse
+	}
+
+	return nil
 }
 
+// verifyID reports whether hash is the ezid for the server ID id. No
+// hash verifies an unknown (empty) ID.
 func verifyID(id, hash string) bool {
+
+	if id == "" {
+		return false
+	}
+
 	h := fmt.Sprintf("%x", md5.Sum([]byte(id)))
 
-	return h == hash
+	return subtle.ConstantTimeCompare([]byte(h), []byte(strings.ToLower(hash))) == 1
+}
+
+// probeClient returns the http.Client used to ping r and a function
+// releasing its resources. Its transport is a copy of the Client's with
+// TLS set up for r.ServerName, certificate pinning and strict
+// verification, and dialing restricted by the address policy, as
+// needed, unless the Client uses a RoundTripper other than
+// *http.Transport, which is used unchanged.
+func (c Client) probeClient(r Record, serverID string) (*http.Client, func()) {
+
+	httpClient := c.Client
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	https := strings.HasPrefix(r.URL, "https:")
+	pin := c.Pins != nil && serverID != "" && https
+
+	if r.ServerName == "" && !pin && !(c.StrictTLS && https) && c.Policy == nil {
+		return httpClient, func() {}
+	}
+
+	tr := cloneTransport(httpClient.Transport)
+	if tr == nil {
+		return httpClient, func() {}
+	}
+
+	if r.ServerName != "" {
+		tr.TLSClientConfig.ServerName = r.ServerName
+	}
+
+	if c.StrictTLS {
+		// Complete the handshake whatever the certificate so the ping
+		// is answered; it is verified afterwards (see trusted)
+		tr.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	if pin {
+		c.pinTLS(tr.TLSClientConfig, r, serverID)
+	}
+
+	if c.Policy != nil {
+		c.Policy.guard(tr, c.Resolver)
+	}
+
+	hc := *httpClient
+	hc.Transport = tr
+
+	return &hc, tr.CloseIdleConnections
+}
+
+// cloneTransport returns a copy of rt with a non-nil TLS config, or nil
+// if rt is not an *http.Transport and cannot be adjusted.
+func cloneTransport(rt http.RoundTripper) *http.Transport {
+
+	var tr *http.Transport
+
+	switch t := rt.(type) {
+	case nil:
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		tr = t.Clone()
+	default:
+		return nil
+	}
+
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+
+	return tr
+}
+
+// trusted reports whether the TLS connection state cs from pinging r
+// authenticates the server with the given ID: its certificate must
+// either match the pin for the server or have a valid chain for the
+// expected hostname. If it was verified by hostname on a route to the
+// device itself, it is pinned when pinning is enabled.
+func (c Client) trusted(r Record, serverID string, cs *tls.ConnectionState) bool {
+
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return false
+	}
+
+	leaf := cs.PeerCertificates[0]
+
+	if c.Pins != nil {
+		pin, err := c.Pins.GetPin(serverID)
+		if err == nil && pin != nil && bytes.Equal(certPin(leaf), pin) {
+			return true
+		}
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       r.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	var cfg *tls.Config
+
+	if c.Client != nil {
+		if tr, ok := c.Client.Transport.(*http.Transport); ok {
+			cfg = tr.TLSClientConfig
+		}
+	}
+
+	if cfg != nil {
+		opts.Roots = cfg.RootCAs
+	}
+
+	if opts.DNSName == "" && net.ParseIP(urlHost(r.URL)) == nil {
+		opts.DNSName = urlHost(r.URL)
+	}
+
+	if opts.DNSName == "" && cfg != nil {
+		opts.DNSName = cfg.ServerName
+	}
+
+	if opts.DNSName == "" {
+		return false
+	}
+
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := leaf.Verify(opts); err != nil {
+		return false
+	}
+
+	if c.Pins != nil && isNameRoute(r) {
+		c.Pins.SetPin(serverID, certPin(leaf))
+	}
+
+	return true
 }
@@ -0,0 +1,190 @@
+package qcon
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AddrPolicy restricts the IP addresses a Client connects to when
+// testing Records, for use when the QuickConnect ID (and so the
+// addresses returned by the control server) cannot be trusted.
+//
+// An address is allowed if it is in none of the Deny networks and, when
+// Allow is not empty, in at least one of the Allow networks. IPv4
+// addresses are matched in their 4 byte form.
+type AddrPolicy struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// PublicOnly returns a policy denying loopback, private, link-local,
+// shared (CGNAT), multicast, documentation and other special purpose
+// networks, so only addresses routable on the internet are allowed.
+// IPv6 transition networks (NAT64, 6to4, Teredo and the 6to4 relay
+// anycast prefix) are also denied, as they embed IPv4 addresses that may
+// be internal.
+func PublicOnly() *AddrPolicy {
+
+	deny, err := ParseCIDRs(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24",
+		"192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+		"192.88.99.0/24", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48", "100::/64",
+		"2001::/32", "2001:db8::/32", "2002::/16", "fc00::/7", "fe80::/10", "ff00::/8",
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	return &AddrPolicy{Deny: deny}
+}
+
+// ParseCIDRs parses a list of networks in CIDR notation, such as
+// "10.0.0.0/8" or "fd00::/8".
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// Allowed reports whether the policy allows connecting to ip.
+func (p *AddrPolicy) Allowed(ip net.IP) bool {
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, n := range p.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return true
+	}
+
+	for _, n := range p.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkURL returns a *BlockedError if the host of rawURL is an IP
+// address the policy does not allow.
+func (p *AddrPolicy) checkURL(rawURL string) error {
+
+	ip := net.ParseIP(urlHost(rawURL))
+	if ip != nil && !p.Allowed(ip) {
+		return &BlockedError{IP: ip}
+	}
+
+	return nil
+}
+
+// guard adjusts tr to enforce the policy when connecting. Proxies are
+// disabled, as the policy could not be enforced on the proxied
+// connection. Custom TLS dialers are wrapped as well as DialContext, so
+// they are passed the checked address rather than the hostname.
+func (p *AddrPolicy) guard(tr *http.Transport, resolver HostResolver) {
+
+	tr.Proxy = nil
+	tr.DialContext = p.dialer(tr.DialContext, resolver)
+
+	if dialTLS := tr.DialTLS; dialTLS != nil && tr.DialTLSContext == nil {
+		tr.DialTLSContext = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(network, addr)
+		}
+	}
+
+	tr.DialTLS = nil
+
+	if tr.DialTLSContext != nil {
+		tr.DialTLSContext = p.dialer(tr.DialTLSContext, resolver)
+	}
+}
+
+// dialer wraps dial (or a default net.Dialer if nil) to enforce the
+// policy. Hostnames are resolved here, using resolver if not nil, and
+// only an allowed address is passed on to dial, so a name cannot be
+// re-resolved to a denied address between the check and the connection.
+func (p *AddrPolicy) dialer(dial func(context.Context, string, string) (net.Conn, error), resolver HostResolver) func(context.Context, string, string) (net.Conn, error) {
+
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var ips []net.IPAddr
+
+		ip, zone := splitZone(host)
+
+		if ip != nil {
+			ips = []net.IPAddr{{IP: ip, Zone: zone}}
+		} else {
+			ips, err = resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = &BlockedError{Host: host}
+
+		for _, a := range ips {
+			if !p.Allowed(a.IP) {
+				if be, ok := err.(*BlockedError); ok && be.IP == nil {
+					be.IP = a.IP
+				}
+				continue
+			}
+
+			var conn net.Conn
+
+			conn, err = dial(ctx, network, net.JoinHostPort(a.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+
+		return nil, err
+	}
+}
+
+// splitZone parses host as an IP address with optional IPv6 zone,
+// returning a nil IP if it is not an address.
+func splitZone(host string) (net.IP, string) {
+
+	var zone string
+
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+
+	return net.ParseIP(host), zone
+}
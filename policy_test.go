@@ -0,0 +1,209 @@
+package qcon
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAddrPolicy(t *testing.T) {
+
+	public := PublicOnly()
+
+	allow, err := ParseCIDRs("192.168.1.0/24", "fd12::/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lan := &AddrPolicy{Allow: allow, Deny: []*net.IPNet{mustCIDR("192.168.1.1/32")}}
+
+	tests := []struct {
+		p   *AddrPolicy
+		ip  string
+		exp bool
+	}{
+		{public, "127.0.0.1", false},
+		{public, "169.254.169.254", false},
+		{public, "10.20.1.100", false},
+		{public, "100.64.0.1", false},
+		{public, "0.0.0.0", false},
+		{public, "::ffff:10.0.0.1", false},
+		{public, "::1", false},
+		{public, "fe80::211:32ff:fe63:bca8", false},
+		{public, "fd00::1", false},
+		{public, "ff02::1", false},
+		{public, "64:ff9b::a00:1", false},              // NAT64 of 10.0.0.1
+		{public, "64:ff9b:1::a00:1", false},            // local-use NAT64
+		{public, "2002:a00:1::1", false},               // 6to4 of 10.0.0.1
+		{public, "2001:0:4136:e378::f5ff:fffe", false}, // Teredo
+		{public, "192.88.99.1", false},                 // 6to4 relay anycast
+		{public, "75.66.42.168", true},
+		{public, "2606:4700::1111", true},
+		{lan, "192.168.1.20", true},
+		{lan, "192.168.1.1", false},
+		{lan, "192.168.2.20", false},
+		{lan, "fd12::20", true},
+		{lan, "75.66.42.168", false},
+	}
+
+	for _, tc := range tests {
+		if got := tc.p.Allowed(net.ParseIP(tc.ip)); got != tc.exp {
+			t.Errorf("%s: expected %v, got %v", tc.ip, tc.exp, got)
+		}
+	}
+
+	if _, err := ParseCIDRs("10.0.0.0"); err == nil {
+		t.Error("expected error for address without prefix length")
+	}
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestPolicyProbe(t *testing.T) {
+
+	srv := newTLSNAS()
+	defer srv.Close()
+
+	port := urlPort(srv.URL)
+	ctx := context.Background()
+
+	c := tlsClient(srv)
+	c.Policy = PublicOnly()
+
+	// Hostnames are checked on the addresses they resolve to when
+	// dialing, here a DDNS name rebound to loopback
+	c.Resolver = fakeResolver{
+		"nas.example.com": {"127.0.0.1"},
+		"mixed.example":   {"10.0.0.1", "127.0.0.1"},
+	}
+
+	tests := []struct {
+		r   Record
+		exp ConnState
+	}{
+		{Record{URL: "https://127.0.0.1:" + port}, StateBlocked},
+		{Record{URL: "https://[fe80::1%25eth0]:" + port}, StateBlocked},
+		{Record{URL: "https://nas.example.com:" + port}, StateBlocked},
+		{Record{URL: "https://mixed.example:" + port}, StateBlocked},
+	}
+
+	for _, tc := range tests {
+		if s, _ := c.probe(ctx, testServerID, tc.r); s != tc.exp {
+			t.Errorf("%s: expected state %d, got %d", tc.r.URL, tc.exp, s)
+		}
+	}
+
+	_, _, err := c.ping(ctx, Record{URL: "https://nas.example.com:" + port}, testServerID)
+
+	var be *BlockedError
+	if !errors.Is(err, ErrBlocked) || !errors.As(err, &be) || be.Host != "nas.example.com" || !be.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Allowing loopback lets the same names through
+	c.Policy = &AddrPolicy{Allow: []*net.IPNet{mustCIDR("127.0.0.0/8")}}
+
+	for _, u := range []string{"https://127.0.0.1:", "https://nas.example.com:", "https://mixed.example:"} {
+		r := Record{URL: u + port, ServerName: "example.com"}
+		if s, _ := c.probe(ctx, testServerID, r); s != StateOK {
+			t.Errorf("%s: expected StateOK, got %d", r.URL, s)
+		}
+	}
+}
+
+func TestPolicyDialTLS(t *testing.T) {
+
+	srv := newTLSNAS()
+	defer srv.Close()
+
+	port := urlPort(srv.URL)
+	ctx := context.Background()
+
+	var dials int32
+
+	c := tlsClient(srv)
+	c.Policy = PublicOnly()
+	c.Resolver = fakeResolver{"nas.example.com": {"127.0.0.1"}}
+
+	tr := c.Client.Transport.(*http.Transport)
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), nil
+	}
+
+	// A custom TLS dialer does not bypass the policy
+	for _, u := range []string{"https://127.0.0.1:", "https://nas.example.com:"} {
+		if s, _ := c.probe(ctx, testServerID, Record{URL: u + port}); s != StateBlocked {
+			t.Errorf("%s: expected StateBlocked, got %d", u, s)
+		}
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 0 {
+		t.Errorf("custom TLS dialer called %d times for denied addresses", n)
+	}
+
+	// Allowed addresses go through it
+	c.Policy = &AddrPolicy{Allow: []*net.IPNet{mustCIDR("127.0.0.0/8")}}
+
+	c.probe(ctx, testServerID, Record{URL: "https://nas.example.com:" + port})
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("expected custom TLS dialer to be called once, got %d", n)
+	}
+}
+
+func TestPolicyResolve(t *testing.T) {
+
+	defer setZones()()
+
+	c := Client{
+		Client: &http.Client{
+			Transport: &mockTransport{
+				responses: map[string]response{
+					defaultServURL:                         {Status: 200, Body: testServResp},
+					"https://10.20.1.100:5001" + pingPath:  {Status: 200, Body: testPingSuccess},
+					"https://75.66.42.168:5001" + pingPath: {Status: 200, Body: testPingSuccess},
+				},
+			},
+		},
+		Policy: PublicOnly(),
+	}
+
+	info, err := c.GetInfo(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := c.UpdateState(context.Background(), &info); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, r := range info.Records {
+		switch r.URL {
+		case "https://10.20.1.100:5001":
+			if r.State != StateBlocked {
+				t.Errorf("%s: expected StateBlocked, got %d", r.URL, r.State)
+			}
+		case "https://75.66.42.168:5001":
+			if r.State != StateOK {
+				t.Errorf("%s: expected StateOK, got %d", r.URL, r.State)
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package qcon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeResult is the outcome of pinging info.Records[i].
+type probeResult struct {
+	i     int
+	state ConnState
+	err   error
+}
+
+// updateStaggered implements UpdateState when Client.Stagger is set.
+// Records are pinged one at a time in priority order, alternating
+// between IPv6 and IPv4 hosts, with each new ping started Stagger after
+// the previous one or as soon as it fails (RFC 8305). Once a Record
+// answers, pings to lower priority Records are cancelled or never
+// started; their State is left as StateUnknown.
+func (c Client) updateStaggered(ctx context.Context, info *Info) error {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	order := probeOrder(info.Records)
+	cancels := make(map[int]context.CancelFunc)
+	results := make(chan probeResult, len(order))
+
+	// best is the highest priority Type that has answered so far
+	best := maxRecordType
+
+	launch := time.NewTimer(0)
+	defer launch.Stop()
+
+	// pings still running when UpdateState returns are cancelled and
+	// waited for, so they finish before the caller uses info
+	var wg sync.WaitGroup
+
+	var err error
+
+	for err == nil {
+
+		// skip pending Records outranked by one that already answered
+		for len(order) > 0 && info.Records[order[0]].Type > best {
+			order = order[1:]
+		}
+
+		if len(order) == 0 && len(cancels) == 0 {
+			break
+		}
+
+		select {
+		case <-launch.C:
+			if len(order) == 0 {
+				break
+			}
+
+			i := order[0]
+			order = order[1:]
+
+			pctx, pcancel := context.WithCancel(ctx)
+			cancels[i] = pcancel
+
+			wg.Add(1)
+			go func(i int, r Record) {
+				defer wg.Done()
+				state, err := c.probe(pctx, info.ServerID, r)
+				results <- probeResult{i: i, state: state, err: err}
+			}(i, info.Records[i])
+
+			launch.Reset(c.Stagger)
+
+		case res := <-results:
+			pcancel, ok := cancels[res.i]
+			if !ok {
+				// already cancelled as lower priority
+				break
+			}
+
+			pcancel()
+			delete(cancels, res.i)
+
+			info.Records[res.i].State = res.state
+			info.Records[res.i].Err = res.err
+
+			if res.state != StateOK {
+				// don't wait out the stagger after a failure
+				if !launch.Stop() {
+					select {
+					case <-launch.C:
+					default:
+					}
+				}
+				launch.Reset(0)
+				break
+			}
+
+			if t := info.Records[res.i].Type; t < best {
+				best = t
+
+				for j, pc := range cancels {
+					if info.Records[j].Type > best {
+						pc()
+						delete(cancels, j)
+					}
+				}
+			}
+
+		case <-deadline.C:
+			err = ErrTimeout
+		case <-ctx.Done():
+			err = ErrCancelled
+		}
+	}
+
+	cancel()
+	wg.Wait()
+
+	if err == ErrTimeout {
+		return nil
+	}
+
+	return err
+}
+
+// probe pings r and returns the resulting connection state, along with
+// the reason for any state other than StateOK.
+func (c Client) probe(ctx context.Context, serverID string, r Record) (ConnState, error) {
+
+	_, cs, err := c.ping(ctx, r, serverID)
+	if err != nil {
+		if errors.Is(err, ErrPinMismatch) {
+			return StatePinMismatch, err
+		}
+		if errors.Is(err, ErrBlocked) {
+			return StateBlocked, err
+		}
+		var pe *PingError
+		if errors.As(err, &pe) && pe.Kind == PingIdentity {
+			return StateInvalidServer, err
+		}
+		return StateConnectFailed, err
+	}
+
+	if c.StrictTLS && !c.trusted(r, serverID, cs) {
+		return StateUntrustedTLS, ErrUntrustedTLS
+	}
+
+	return StateOK, nil
+}
+
+// probeOrder returns the indices of recs in the order they should be
+// probed: priority order, interleaved by address family starting with
+// the family of the highest priority Record.
+func probeOrder(recs []Record) []int {
+
+	var first, second []int
+
+	for i, r := range recs {
+		if isIPv6URL(r.URL) == isIPv6URL(recs[0].URL) {
+			first = append(first, i)
+		} else {
+			second = append(second, i)
+		}
+	}
+
+	order := make([]int, 0, len(recs))
+
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			order = append(order, first[i])
+		}
+		if i < len(second) {
+			order = append(order, second[i])
+		}
+	}
+
+	return order
+}
+
+// isIPv6URL reports whether the host of rawURL is an IPv6 address.
+func isIPv6URL(rawURL string) bool {
+
+	ip := net.ParseIP(urlHost(rawURL))
+
+	return ip != nil && ip.To4() == nil
+}
+
+// urlHost returns the host of rawURL without any port or IPv6 zone.
+func urlHost(rawURL string) string {
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	host := u.Hostname()
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	return host
+}
@@ -0,0 +1,453 @@
+package qcon
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxy is an http.Handler forwarding requests to the DSM web service
+// of a device through its best verified route, so that tools which only
+// accept a fixed URL can reach a device wherever it is.
+//
+// Requests are sent with the Host header (and TLS server name) set to
+// the device's own hostname where known: the hostname a route address
+// was looked up from, the route hostname itself, or the device's FQDN or
+// DDNS name. Certificates are verified against that name as usual, or
+// against the pinned key if the Client has Pins. Origin and Referer
+// headers naming the proxy are rewritten to name the device, while
+// redirects to the device and the Domain and Secure attributes of its
+// cookies are rewritten to refer to the proxy.
+//
+// Routes are resolved on the first request. When a route cannot be
+// connected to, the next verified route is used, and once all have
+// failed the device is resolved again. Requests without a body are
+// retried on the next route; others fail with 502 Bad Gateway. With
+// Refresh set, the device is resolved again in the background while the
+// existing routes stay in use, and they are kept if that fails.
+//
+// Client.StrictTLS applies when resolving, so that only routes
+// authenticated by TLS are used. Connections made by the Proxy always
+// verify the certificate during the handshake.
+type Proxy struct {
+	Client  *Client       // DefaultClient if nil
+	ID      string        // QuickConnect ID of the device
+	Refresh time.Duration // resolve again after this long if not zero
+
+	mu       sync.Mutex
+	routes   []*proxyRoute
+	resolved time.Time
+	pending  *proxyResolve // resolution in progress, if any
+	closed   bool
+}
+
+// proxyResolve is a resolution of the device for a Proxy, shared by the
+// requests waiting for it.
+type proxyResolve struct {
+	done chan struct{}
+	err  error
+}
+
+// proxyRoute is a verified route to the device used by a Proxy.
+type proxyRoute struct {
+	target    *url.URL
+	host      string // Host header sent to the device
+	transport http.RoundTripper
+	close     func()
+}
+
+// NewProxy returns a Proxy for the device with the given QuickConnect
+// ID using c, or DefaultClient if c is nil.
+func NewProxy(c *Client, id string) *Proxy {
+	return &Proxy{Client: c, ID: id}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	retry := req.Body == nil || req.Body == http.NoBody
+
+	for {
+		rt, err := p.route(req.Context())
+		if err != nil {
+			http.Error(w, "qcon: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		var failed error
+
+		rp := p.reverseProxy(rt, req, &failed)
+		rp.ServeHTTP(w, req)
+
+		if failed == nil {
+			return
+		}
+
+		if req.Context().Err() != nil {
+			// the client went away; not a failure of the route
+			return
+		}
+
+		if !p.drop(rt) || !retry {
+			http.Error(w, "qcon: "+failed.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+}
+
+// reverseProxy returns the ReverseProxy forwarding req to rt. An error
+// connecting to the device is stored in failed, without writing a
+// response, so the request can be retried.
+func (p *Proxy) reverseProxy(rt *proxyRoute, req *http.Request, failed *error) *httputil.ReverseProxy {
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	local := &url.URL{Scheme: scheme, Host: req.Host}
+	remote := &url.URL{Scheme: rt.target.Scheme, Host: rt.host}
+
+	return &httputil.ReverseProxy{
+		Transport: rt.transport,
+
+		Director: func(out *http.Request) {
+			out.URL.Scheme = rt.target.Scheme
+			out.URL.Host = rt.target.Host
+			out.Host = rt.host
+
+			if out.Header.Get("Origin") == local.String() {
+				out.Header.Set("Origin", remote.String())
+			}
+
+			if ref := out.Header.Get("Referer"); strings.HasPrefix(ref, local.String()+"/") {
+				out.Header.Set("Referer", remote.String()+strings.TrimPrefix(ref, local.String()))
+			}
+		},
+
+		ModifyResponse: func(resp *http.Response) error {
+			rewriteLocation(resp, local, rt)
+			rewriteCookies(resp, local)
+			return nil
+		},
+
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			*failed = err
+		},
+	}
+}
+
+// rewriteLocation changes a redirect to the device to point to the
+// proxy instead.
+func rewriteLocation(resp *http.Response, local *url.URL, rt *proxyRoute) {
+
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return
+	}
+
+	u, err := url.Parse(loc)
+	if err != nil || !u.IsAbs() {
+		return
+	}
+
+	if u.Host != rt.host && u.Host != rt.target.Host && u.Hostname() != hostOnly(rt.host) {
+		return
+	}
+
+	u.Scheme = local.Scheme
+	u.Host = local.Host
+
+	resp.Header.Set("Location", u.String())
+}
+
+// rewriteCookies makes cookies set by the device apply to the proxy:
+// the Domain attribute is removed, as is Secure if the proxy is not
+// served over HTTPS. The headers are edited as text, so other
+// attributes, including any not understood here, are passed through.
+func rewriteCookies(resp *http.Response, local *url.URL) {
+
+	headers := resp.Header["Set-Cookie"]
+
+	for i, h := range headers {
+		parts := strings.Split(h, ";")
+		kept := parts[:1]
+
+		for _, attr := range parts[1:] {
+			name := strings.TrimSpace(attr)
+			if j := strings.IndexByte(name, '='); j >= 0 {
+				name = strings.TrimSpace(name[:j])
+			}
+
+			if strings.EqualFold(name, "Domain") || strings.EqualFold(name, "Secure") && local.Scheme != "https" {
+				continue
+			}
+
+			kept = append(kept, attr)
+		}
+
+		headers[i] = strings.Join(kept, ";")
+	}
+}
+
+// hostOnly returns host without any port.
+func hostOnly(host string) string {
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return host
+}
+
+// route returns the route currently in use, resolving the device if
+// there is none.
+func (p *Proxy) route(ctx context.Context) (*proxyRoute, error) {
+
+	p.mu.Lock()
+
+	if len(p.routes) > 0 {
+		rt := p.routes[0]
+
+		if p.Refresh > 0 && time.Since(p.resolved) >= p.Refresh {
+			p.refresh()
+		}
+
+		p.mu.Unlock()
+		return rt, nil
+	}
+
+	pr := p.refresh()
+	p.mu.Unlock()
+
+	select {
+	case <-pr.done:
+	case <-ctx.Done():
+		return nil, ErrCancelled
+	}
+
+	if pr.err != nil {
+		return nil, pr.err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.routes) == 0 {
+		// dropped again already
+		return nil, ErrCannotAccess
+	}
+
+	return p.routes[0], nil
+}
+
+// refresh starts resolving the device unless that is already in
+// progress, and returns the resolution. The routes are replaced once it
+// succeeds; until then, and if it fails, the existing routes are kept.
+// p.mu must be held.
+func (p *Proxy) refresh() *proxyResolve {
+
+	if p.pending != nil {
+		return p.pending
+	}
+
+	pr := &proxyResolve{done: make(chan struct{})}
+	p.pending = pr
+
+	go func() {
+		routes, err := p.resolve()
+
+		p.mu.Lock()
+
+		if err == nil && !p.closed {
+			p.closeRoutes()
+			p.routes = routes
+		} else {
+			for _, rt := range routes {
+				rt.close()
+			}
+		}
+
+		// a failed refresh is retried after Refresh, or once the routes
+		// in use have all failed
+		p.resolved = time.Now()
+		p.pending = nil
+
+		p.mu.Unlock()
+
+		pr.err = err
+		close(pr.done)
+	}()
+
+	return pr
+}
+
+// resolve resolves the device and returns routes for its verified
+// Records. It runs on a context of its own, as its result is shared by
+// all requests.
+func (p *Proxy) resolve() ([]*proxyRoute, error) {
+
+	c := p.Client
+	if c == nil {
+		c = DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.sharedTimeout())
+	defer cancel()
+
+	res, err := c.ResolveDetailed(ctx, p.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*proxyRoute
+
+	for _, r := range res.Records {
+		if rt := c.newProxyRoute(r, &res.Info); rt != nil {
+			routes = append(routes, rt)
+		}
+	}
+
+	if len(routes) == 0 {
+		return nil, ErrCannotAccess
+	}
+
+	return routes, nil
+}
+
+// drop stops using rt after a failure, reporting whether another route
+// is to be tried (including by resolving again).
+func (p *Proxy) drop(rt *proxyRoute) bool {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.routes) == 0 || p.routes[0] != rt {
+		// already dropped by a concurrent request
+		return true
+	}
+
+	rt.close()
+	p.routes = p.routes[1:]
+
+	// once every route has failed, resolve again but don't retry
+	return len(p.routes) > 0
+}
+
+// Close releases the connections held by the Proxy.
+func (p *Proxy) Close() {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.closeRoutes()
+}
+
+func (p *Proxy) closeRoutes() {
+
+	for _, rt := range p.routes {
+		rt.close()
+	}
+
+	p.routes = nil
+}
+
+// newProxyRoute returns the route for forwarding to Record r of the
+// device described by info, or nil if its URL is invalid or, with
+// StrictTLS set, it is not an HTTPS URL.
+func (c Client) newProxyRoute(r Record, info *Info) *proxyRoute {
+
+	target, err := url.Parse(r.URL)
+	if err != nil || c.StrictTLS && target.Scheme != "https" {
+		return nil
+	}
+
+	if r.ServerName == "" && net.ParseIP(urlHost(r.URL)) != nil {
+		r.ServerName = deviceName(info)
+	}
+
+	// Certificates are verified during the handshake, rather than
+	// afterwards as when testing Records with StrictTLS
+	c.StrictTLS = false
+
+	httpClient, done := c.probeClient(r, info.ServerID)
+
+	rt := &proxyRoute{
+		target:    target,
+		host:      target.Host,
+		transport: httpClient.Transport,
+		close:     done,
+	}
+
+	if rt.transport == nil {
+		rt.transport = http.DefaultTransport
+	}
+
+	if r.ServerName != "" {
+		rt.host = hostHeader(r.URL, r.ServerName)
+	}
+
+	return rt
+}
+
+// Transport returns an http.RoundTripper for sending requests to the
+// device over the route of Record r, one of the Records of info. As
+// with Proxy, requests to the route's host are sent with the Host header
+// and TLS server name set to the device's hostname where known, and
+// certificates are verified against that name (or the pinned key). With
+// StrictTLS set, requests over a route other than HTTPS fail with
+// ErrUntrustedTLS. Its CloseIdleConnections method releases the
+// connections it holds.
+func (c Client) Transport(r Record, info *Info) http.RoundTripper {
+
+	t := &routeTransport{route: c.newProxyRoute(r, info), err: ErrParse}
+	if c.StrictTLS && !strings.HasPrefix(r.URL, "https:") {
+		t.err = ErrUntrustedTLS
+	}
+
+	return t
+}
+
+// routeTransport is the RoundTripper returned by Client.Transport.
+type routeTransport struct {
+	route *proxyRoute
+	err   error // returned if route is nil
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if t.route == nil {
+		return nil, t.err
+	}
+
+	if req.URL.Host == t.route.target.Host && (req.Host == "" || req.Host == req.URL.Host) {
+		req = req.Clone(req.Context())
+		req.Host = t.route.host
+	}
+
+	return t.route.transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections to the route.
+func (t *routeTransport) CloseIdleConnections() {
+	if t.route != nil {
+		t.route.close()
+	}
+}
+
+// deviceName returns the FQDN or DDNS hostname of the device, if any.
+func deviceName(info *Info) string {
+
+	for _, name := range []string{info.HTTPS.Server.FQDN, info.HTTPS.Server.DDNS} {
+		if name != "" && name != "NULL" {
+			return name
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,254 @@
+package qcon
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newProxyNAS starts a TLS server answering pings for testServerID and
+// serving test pages identifying it by name.
+func newProxyNAS(name string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/webman/pingpong.cgi":
+			fmt.Fprintf(w, `{"success": true, "ezid": "%x"}`, md5.Sum([]byte(testServerID)))
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "id", Value: "abc", Domain: "example.com", Secure: true})
+			w.Header().Add("Set-Cookie", "pref=a b; Path=/; domain=example.com; secure; Priority=High")
+			http.Redirect(w, r, "https://"+r.Host+"/home", http.StatusFound)
+		default:
+			fmt.Fprintf(w, "%s host=%s origin=%s", name, r.Host, r.Header.Get("Origin"))
+		}
+	}))
+}
+
+func TestProxy(t *testing.T) {
+
+	nas1 := newProxyNAS("nas1")
+	defer nas1.Close()
+
+	nas2 := newProxyNAS("nas2")
+	defer nas2.Close()
+
+	port1, _ := strconv.Atoi(urlPort(nas1.URL))
+	port2, _ := strconv.Atoi(urlPort(nas2.URL))
+
+	// The device is reached through its FQDN on two ports, with
+	// ext_port (nas2) ranked first
+	si := ServerInfo{
+		Server:  Server{ServerID: testServerID, FQDN: "example.com", DDNS: "NULL", DSState: "CONNECTED"},
+		Service: Service{Port: port1, ExtPort: port2},
+	}
+
+	ctrl := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]ServerInfo{si, si})
+	}))
+	defer ctrl.Close()
+
+	c := tlsClient(nas1)
+	c.servURL = ctrl.URL
+	c.Timeout = 200 * time.Millisecond
+	c.Resolver = fakeResolver{"example.com": {"127.0.0.1"}}
+
+	p := NewProxy(&c, "foo")
+	defer p.Close()
+
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	get := func(path string, hdr ...string) (*http.Response, string) {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodGet, front.URL+path, nil)
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+
+		tr := &http.Transport{}
+		defer tr.CloseIdleConnections()
+
+		resp, err := (&http.Client{
+			Transport: tr,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		return resp, string(body)
+	}
+
+	// Host and Origin name the device rather than the proxy
+	_, body := get("/", "Origin", front.URL)
+	if exp := fmt.Sprintf("nas2 host=example.com:%d origin=https://example.com:%d", port2, port2); body != exp {
+		t.Errorf("unexpected response:\n  exp: %s\n  got: %s", exp, body)
+	}
+
+	// Redirects and cookies refer to the proxy
+	resp, _ := get("/login")
+
+	if loc := resp.Header.Get("Location"); loc != front.URL+"/home" {
+		t.Errorf("unexpected Location %s", loc)
+	}
+
+	if sc := resp.Header.Get("Set-Cookie"); strings.Contains(sc, "Domain") || strings.Contains(sc, "Secure") || !strings.HasPrefix(sc, "id=abc") {
+		t.Errorf("unexpected Set-Cookie %s", sc)
+	}
+
+	// Cookies Go cannot parse are still passed on
+	if sc := resp.Header["Set-Cookie"]; len(sc) != 2 || sc[1] != "pref=a b; Path=/; Priority=High" {
+		t.Errorf("unexpected Set-Cookie headers %q", sc)
+	}
+
+	// When the route drops, the next one is used
+	nas2.Close()
+
+	_, body = get("/")
+	if !strings.HasPrefix(body, "nas1 host=example.com:"+strconv.Itoa(port1)) {
+		t.Errorf("unexpected response after failover: %s", body)
+	}
+}
+
+func TestTransport(t *testing.T) {
+
+	nas := newProxyNAS("nas")
+	defer nas.Close()
+
+	port := urlPort(nas.URL)
+	c := tlsClient(nas)
+
+	info := &Info{ServerID: testServerID, HTTPS: ServerInfo{Server: Server{FQDN: "example.com"}}}
+
+	tests := []struct {
+		r   Record
+		exp string
+		ok  bool
+	}{
+		{Record{URL: "https://127.0.0.1:" + port, ServerName: "example.com"}, "nas host=example.com:" + port, true},
+		{Record{URL: "https://127.0.0.1:" + port}, "nas host=example.com:" + port, true},
+		{Record{URL: "https://127.0.0.1:" + port, ServerName: "nas.example.net"}, "", false},
+	}
+
+	for _, tc := range tests {
+		tr := c.Transport(tc.r, info)
+
+		resp, err := (&http.Client{Transport: tr}).Get(tc.r.URL + "/")
+		if !tc.ok {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: expected certificate error for %s", tc.r.URL, tc.r.ServerName)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if !strings.HasPrefix(string(body), tc.exp) {
+			t.Errorf("unexpected response %q", body)
+		}
+
+		tr.(interface{ CloseIdleConnections() }).CloseIdleConnections()
+	}
+}
+
+func TestProxyRefresh(t *testing.T) {
+
+	nas := newProxyNAS("nas")
+	defer nas.Close()
+
+	port, _ := strconv.Atoi(urlPort(nas.URL))
+
+	si := ServerInfo{
+		Server:  Server{ServerID: testServerID, FQDN: "example.com", DDNS: "NULL", DSState: "CONNECTED"},
+		Service: Service{Port: port},
+	}
+
+	var down int32
+
+	ctrl := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) != 0 {
+			// a slow, failing control server
+			time.Sleep(300 * time.Millisecond)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]ServerInfo{si, si})
+	}))
+	defer ctrl.Close()
+
+	c := tlsClient(nas)
+	c.servURL = ctrl.URL
+	c.Timeout = 200 * time.Millisecond
+	c.Resolver = fakeResolver{"example.com": {"127.0.0.1"}}
+
+	p := NewProxy(&c, "foo")
+	p.Refresh = time.Millisecond
+	defer p.Close()
+
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	get := func() (string, time.Duration) {
+		t.Helper()
+
+		start := time.Now()
+
+		resp, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		return string(body), time.Since(start)
+	}
+
+	if body, _ := get(); !strings.HasPrefix(body, "nas ") {
+		t.Fatalf("unexpected response %q", body)
+	}
+
+	// Refreshing runs in the background, and the routes in use are kept
+	// when it fails
+	atomic.StoreInt32(&down, 1)
+	time.Sleep(2 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		body, d := get()
+		if !strings.HasPrefix(body, "nas ") {
+			t.Fatalf("unexpected response during failed refresh %q", body)
+		}
+		if d > 250*time.Millisecond {
+			t.Errorf("request waited %s for refresh", d)
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	// With StrictTLS, routes other than HTTPS are refused
+	c.StrictTLS = true
+
+	tr := c.Transport(Record{URL: "http://127.0.0.1:" + strconv.Itoa(port)}, &Info{ServerID: testServerID})
+	if _, err := (&http.Client{Transport: tr}).Get("http://127.0.0.1:" + strconv.Itoa(port) + "/"); !errors.Is(err, ErrUntrustedTLS) {
+		t.Errorf("expected ErrUntrustedTLS, got %v", err)
+	}
+}
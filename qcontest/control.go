@@ -0,0 +1,132 @@
+package qcontest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"jbowen.dev/qcon"
+)
+
+// Errno values returned by the fake control server.
+const (
+	ErrNoUnknownID = 4 // no device registered with the requested ID
+	ErrNoNoTunnel  = 9 // request_tunnel for a device without a Relay
+)
+
+// errorResponse is the reply to a failed request, which omits the
+// device details.
+type errorResponse struct {
+	Command  string `json:"command"`
+	ErrNo    int    `json:"errno"`
+	SubErrNo int    `json:"suberrno,omitempty"`
+	Version  int    `json:"version"`
+}
+
+// serveControl answers Serv.php requests from the registered devices.
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqs []qcon.Request
+
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	resps := make([]interface{}, 0, len(reqs))
+
+	for _, req := range reqs {
+		s.mu.Lock()
+		d, ok := s.devices[strings.ToLower(req.ServerID)]
+		s.mu.Unlock()
+
+		resps = append(resps, d.respond(req, ok))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resps)
+}
+
+// respond builds the reply of d to a single request.
+func (d Device) respond(req qcon.Request, found bool) interface{} {
+
+	fail := errorResponse{Command: req.Command, Version: 1}
+
+	switch {
+	case !found:
+		fail.ErrNo = ErrNoUnknownID
+		fail.SubErrNo = 2
+		return fail
+	case d.ErrNo != 0:
+		fail.ErrNo = d.ErrNo
+		return fail
+	case req.Command == qcon.CmdRequestTunnel && d.Relay == nil:
+		fail.ErrNo = ErrNoNoTunnel
+		return fail
+	}
+
+	resp := qcon.ServerInfo{
+		Command: req.Command,
+		Env:     qcon.Env{ControlHost: "global.quickconnect.to", RelayRegion: "us"},
+		Server: qcon.Server{
+			DDNS:     nullify(d.DDNS),
+			DSState:  d.DSState,
+			External: qcon.External{IP: nullify(d.ExternalIP), IPv6: d.ExternalIPv6},
+			FQDN:     nullify(d.FQDN),
+			ServerID: d.ServerID,
+		},
+		Service: qcon.Service{PingPong: "DISCONNECTED"},
+		Version: 1,
+	}
+
+	if resp.Server.DSState == "" {
+		resp.Server.DSState = "CONNECTED"
+	}
+
+	if resp.Server.External.IPv6 == "" {
+		resp.Server.External.IPv6 = "::"
+	}
+
+	for _, ifc := range d.Interfaces {
+		i := qcon.Interface{IP: ifc.IP, Mask: ifc.Mask, Name: ifc.Name, IPv6: []qcon.IPv6Address{}}
+
+		for _, a := range ifc.IPv6 {
+			i.IPv6 = append(i.IPv6, qcon.IPv6Address{Address: a.Address, PrefixLength: a.PrefixLength, Scope: a.Scope})
+		}
+
+		resp.Server.Interface = append(resp.Server.Interface, i)
+	}
+
+	if strings.HasSuffix(req.ID, "_https") {
+		resp.Service.Port, resp.Service.ExtPort = d.HTTPSPort, d.ExtHTTPSPort
+	} else {
+		resp.Service.Port, resp.Service.ExtPort = d.HTTPPort, d.ExtHTTPPort
+	}
+
+	if req.Command == qcon.CmdRequestTunnel {
+		resp.Service.RelayIP = d.Relay.IP
+		resp.Service.RelayIPv6 = d.Relay.IPv6
+		resp.Service.RelayDN = d.Relay.DN
+		resp.Service.RelayDualStack = d.Relay.DualStack
+		resp.Service.RelayPort = d.Relay.Port
+		resp.Service.HTTPSIP = d.Relay.HTTPSIP
+		resp.Service.HTTPSPort = d.Relay.HTTPSPort
+	}
+
+	return resp
+}
+
+// nullify returns s, or "NULL" as the control server reports unset
+// fields if s is empty.
+func nullify(s string) string {
+	if s == "" {
+		return "NULL"
+	}
+
+	return s
+}
@@ -0,0 +1,302 @@
+/*
+Package qcontest provides an in-process fake of the QuickConnect control
+server and of the pingpong endpoints served by Synology devices, for
+testing code built on qcon without network access.
+
+Devices are described declaratively and served from httptest servers:
+
+	srv := qcontest.NewServer(qcontest.Device{
+		ID:       "mynas",
+		ServerID: "012345678",
+		Interfaces: []qcontest.Interface{
+			{Name: "eth0", IP: "10.0.0.5"},
+		},
+		Endpoints: map[string]qcontest.Endpoint{
+			"https://10.0.0.5:5001": {},
+			"http://10.0.0.5:5000":  {Delay: 3 * time.Second},
+		},
+	})
+	defer srv.Close()
+
+	urls, err := srv.Client().Resolve(ctx, "mynas")
+
+The Client returned by Server.Client sends control server requests and
+pings to the fakes, so no other configuration is needed.
+*/
+package qcontest
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"jbowen.dev/qcon"
+)
+
+const pingPath = "/webman/pingpong.cgi"
+
+// Device describes a Synology device registered with the fake control
+// server. Only the addresses listed in Endpoints can be connected to;
+// connections to any other address reported for the device are refused.
+type Device struct {
+	ID           string // QuickConnect ID
+	ServerID     string
+	Interfaces   []Interface
+	ExternalIP   string
+	ExternalIPv6 string
+	FQDN         string
+	DDNS         string
+	HTTPPort     int // 5000 if zero
+	HTTPSPort    int // 5001 if zero
+	ExtHTTPPort  int
+	ExtHTTPSPort int
+	Relay        *Relay // returned for request_tunnel; tunnels fail if nil
+	ErrNo        int    // errno returned for every command if non-zero
+	DSState      string // reported ds_state, "CONNECTED" if empty
+
+	// Endpoints maps URLs such as "https://10.0.0.5:5001" to the
+	// behavior of the device when reached at that address.
+	Endpoints map[string]Endpoint
+}
+
+// Interface is a network interface of a Device.
+type Interface struct {
+	Name string
+	IP   string
+	Mask string
+	IPv6 []IPv6
+}
+
+// IPv6 is an IPv6 address of an Interface. Scope is "link" for
+// link-local addresses and "global" otherwise.
+type IPv6 struct {
+	Address      string
+	Scope        string
+	PrefixLength int
+}
+
+// Relay holds the tunnel details returned by request_tunnel.
+type Relay struct {
+	IP        string
+	IPv6      string
+	DN        string
+	DualStack string
+	Port      int
+	HTTPSIP   string
+	HTTPSPort int
+}
+
+// Endpoint controls how a Device responds when reached at one address.
+// The zero value answers pings correctly and immediately.
+type Endpoint struct {
+	Status  int           // HTTP status of ping replies, 200 if zero
+	EZID    string        // ezid reported, md5 of Device.ServerID if empty
+	Body    string        // raw ping reply body, replacing the JSON reply
+	Delay   time.Duration // wait before answering any request
+	Fail    bool          // refuse connections to this address
+	Handler http.Handler  // serves requests other than pings, 404 if nil
+}
+
+// Server is a fake QuickConnect control server together with the fake
+// device endpoints it describes.
+type Server struct {
+	control *httptest.Server
+
+	mu        sync.Mutex
+	devices   map[string]Device
+	endpoints map[string]*endpoint // keyed by host:port
+}
+
+type endpoint struct {
+	Endpoint
+	srv *httptest.Server
+}
+
+// NewServer starts a fake control server answering for devices. The
+// caller should call Close when finished to shut it down.
+func NewServer(devices ...Device) *Server {
+
+	s := &Server{
+		devices:   make(map[string]Device),
+		endpoints: make(map[string]*endpoint),
+	}
+
+	s.control = httptest.NewServer(http.HandlerFunc(s.serveControl))
+
+	for _, d := range devices {
+		s.Add(d)
+	}
+
+	return s
+}
+
+// Add registers d with the server, starting servers for its Endpoints.
+// A Device with the same ID is replaced, but the Endpoints it had remain
+// reachable.
+func (s *Server) Add(d Device) {
+
+	if d.HTTPPort == 0 {
+		d.HTTPPort = 5000
+	}
+
+	if d.HTTPSPort == 0 {
+		d.HTTPSPort = 5001
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.devices[strings.ToLower(d.ID)] = d
+
+	for rawURL, ep := range d.Endpoints {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			panic(fmt.Sprintf("qcontest: invalid endpoint URL %q: %v", rawURL, err))
+		}
+
+		e := &endpoint{Endpoint: ep}
+
+		h := &nasHandler{serverID: d.ServerID, ep: e}
+		if u.Scheme == "https" {
+			e.srv = httptest.NewTLSServer(h)
+		} else {
+			e.srv = httptest.NewServer(h)
+		}
+
+		if old, ok := s.endpoints[u.Host]; ok {
+			old.srv.Close()
+		}
+
+		s.endpoints[u.Host] = e
+	}
+}
+
+// Close shuts down the control server and all device endpoints.
+func (s *Server) Close() {
+
+	s.control.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.endpoints {
+		e.srv.Close()
+	}
+}
+
+// URL returns the base URL of the fake control server.
+func (s *Server) URL() string {
+	return s.control.URL
+}
+
+// Transport returns an http.Transport that sends QuickConnect control
+// requests to the fake control server and connects to device addresses
+// through their fake Endpoints. Certificates presented by the fake
+// devices are not verified.
+func (s *Server) Transport() *http.Transport {
+
+	return &http.Transport{
+		DialContext: s.dial,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+}
+
+// Client returns a qcon.Client using Transport.
+func (s *Server) Client() *qcon.Client {
+	return &qcon.Client{
+		Client: &http.Client{
+			Transport: s.Transport(),
+		},
+	}
+}
+
+// dial maps a requested address to the listener faking it.
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	var d net.Dialer
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	e, ok := s.endpoints[addr]
+	s.mu.Unlock()
+
+	// relay hostnames are also under quickconnect.to
+	if !ok && (host == "quickconnect.to" || strings.HasSuffix(host, ".quickconnect.to")) {
+		return d.DialContext(ctx, "tcp", s.control.Listener.Addr().String())
+	}
+
+	if !ok || e.Fail {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errConnRefused}
+	}
+
+	return d.DialContext(ctx, "tcp", e.srv.Listener.Addr().String())
+}
+
+var errConnRefused = errors.New("connection refused")
+
+// nasHandler fakes the web server of a device reached at one address.
+type nasHandler struct {
+	serverID string
+	ep       *endpoint
+}
+
+func (h *nasHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if h.ep.Delay > 0 {
+		select {
+		case <-time.After(h.ep.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if r.URL.Path != pingPath {
+		if h.ep.Handler == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		h.ep.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	status := h.ep.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	body := h.ep.Body
+	if body == "" {
+		ezid := h.ep.EZID
+		if ezid == "" {
+			ezid = fmt.Sprintf("%x", md5.Sum([]byte(h.serverID)))
+		}
+
+		b, _ := json.Marshal(map[string]interface{}{
+			"boot_done": true,
+			"ezid":      ezid,
+			"success":   status == http.StatusOK,
+		})
+		body = string(b)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
@@ -0,0 +1,111 @@
+package qcontest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"jbowen.dev/qcon"
+	"jbowen.dev/qcon/qcontest"
+)
+
+func TestResolve(t *testing.T) {
+
+	srv := qcontest.NewServer(qcontest.Device{
+		ID:         "MyNAS",
+		ServerID:   "012345678",
+		ExternalIP: "203.0.113.10",
+		Interfaces: []qcontest.Interface{
+			{Name: "eth0", IP: "10.0.0.5"},
+		},
+		Endpoints: map[string]qcontest.Endpoint{
+			"https://10.0.0.5:5001":     {Delay: 50 * time.Millisecond},
+			"http://10.0.0.5:5000":      {EZID: "00000000000000000000000000000000"},
+			"https://203.0.113.10:5001": {Status: 500},
+			"http://203.0.113.10:5000":  {Delay: 5 * time.Second},
+		},
+	})
+	defer srv.Close()
+
+	c := srv.Client()
+	c.Timeout = 500 * time.Millisecond
+
+	urls, err := c.Resolve(context.Background(), "mynas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(urls) != 1 || urls[0] != "https://10.0.0.5:5001" {
+		t.Errorf("unexpected URLs: %v", urls)
+	}
+}
+
+func TestUnknownID(t *testing.T) {
+
+	srv := qcontest.NewServer()
+	defer srv.Close()
+
+	_, err := srv.Client().GetInfo(context.Background(), "nobody")
+	if err == nil {
+		t.Fatal("expected error for unknown ID")
+	}
+}
+
+func TestRefused(t *testing.T) {
+
+	srv := qcontest.NewServer(qcontest.Device{
+		ID:       "mynas",
+		ServerID: "012345678",
+		Interfaces: []qcontest.Interface{
+			{Name: "eth0", IP: "10.0.0.5"},
+		},
+		Endpoints: map[string]qcontest.Endpoint{
+			"https://10.0.0.5:5001": {Fail: true},
+		},
+	})
+	defer srv.Close()
+
+	c := srv.Client()
+	c.Timeout = 200 * time.Millisecond
+
+	_, err := c.Resolve(context.Background(), "mynas")
+	if err != qcon.ErrCannotAccess {
+		t.Errorf("expected ErrCannotAccess, got %v", err)
+	}
+}
+
+func TestTunnel(t *testing.T) {
+
+	srv := qcontest.NewServer(qcontest.Device{
+		ID:       "mynas",
+		ServerID: "012345678",
+		Interfaces: []qcontest.Interface{
+			{Name: "eth0", IP: "10.0.0.5"},
+		},
+		Relay: &qcontest.Relay{
+			IP:   "198.51.100.7",
+			DN:   "usr1.example.quickconnect.to",
+			Port: 2905,
+		},
+		Endpoints: map[string]qcontest.Endpoint{
+			"https://usr1.example.quickconnect.to:2905": {},
+			"https://198.51.100.7:2905":                 {},
+		},
+	})
+	defer srv.Close()
+
+	c := srv.Client()
+	c.Timeout = 200 * time.Millisecond
+	c.UseTunnel = true
+
+	urls, err := c.Resolve(context.Background(), "mynas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{"https://usr1.example.quickconnect.to:2905", "https://198.51.100.7:2905"}
+
+	if len(urls) != len(exp) || urls[0] != exp[0] || urls[1] != exp[1] {
+		t.Errorf("unexpected URLs:\n  exp: %v\n  got: %v", exp, urls)
+	}
+}
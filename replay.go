@@ -0,0 +1,388 @@
+package qcon
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exchange is the recorded outcome of a single request: either the
+// HTTP status and body of the response or the error returned, along
+// with how long it took in seconds.
+type Exchange struct {
+	Status int     `json:"status"`
+	Body   string  `json:"body"`
+	Delay  float32 `json:"delay"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Fixture holds recorded exchanges keyed by request URL. Control server
+// requests other than get_server_info are keyed by URL#command (eg.
+// "http://global.quickconnect.to/Serv.php#request_tunnel") as they share
+// a URL.
+type Fixture map[string]Exchange
+
+// LoadFixture reads a JSON encoded Fixture from r.
+func LoadFixture(r io.Reader) (Fixture, error) {
+
+	var f Fixture
+
+	err := json.NewDecoder(r).Decode(&f)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Write writes f to w as indented JSON.
+func (f Fixture) Write(w io.Writer) error {
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(f)
+}
+
+// Recorder is an http.RoundTripper which passes requests on to
+// Transport (http.DefaultTransport if nil) and records every exchange,
+// including failures and timings, so that it can be replayed later
+// with ReplayTransport.
+//
+// A Recorder may be used by multiple goroutines at once.
+type Recorder struct {
+	Transport http.RoundTripper
+
+	mu        sync.Mutex
+	exchanges Fixture
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	key, err := fixtureKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := r.Transport
+	if tr == nil {
+		tr = http.DefaultTransport
+	}
+
+	start := time.Now()
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		r.record(key, Exchange{Delay: seconds(time.Since(start)), Error: err.Error()})
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		r.record(key, Exchange{Delay: seconds(time.Since(start)), Error: err.Error()})
+		return nil, err
+	}
+
+	r.record(key, Exchange{Status: resp.StatusCode, Body: string(body), Delay: seconds(time.Since(start))})
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
+
+func (r *Recorder) record(key string, e Exchange) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.exchanges == nil {
+		r.exchanges = make(Fixture)
+	}
+
+	r.exchanges[key] = e
+}
+
+// Fixture returns the exchanges recorded so far with identifying details
+// redacted. Server IDs are replaced with placeholder IDs, with ezid
+// values in ping replies rewritten to match so the fixture still
+// verifies. DDNS, FQDN and relay hostnames are replaced with names under
+// .invalid, and the external, gateway, relay and public interface
+// addresses with documentation addresses (203.0.113.0/24 and
+// 2001:db8::/32). Only private IPv4 and link-local IPv6 interface
+// addresses are kept.
+//
+// Only the values reported by the control server are redacted. Other
+// exchanges recorded, such as pages fetched from the device, may still
+// identify it and should be checked before a fixture is shared.
+func (r *Recorder) Fixture() Fixture {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Gather identifying values from control server responses
+	ids := make(map[string]bool)
+	hosts := make(map[string]bool)
+	ips := make(map[string]bool)
+
+	for _, e := range r.exchanges {
+		var info []ServerInfo
+
+		if json.Unmarshal([]byte(e.Body), &info) != nil {
+			continue
+		}
+
+		for _, i := range info {
+			if i.Server.ServerID != "" {
+				ids[i.Server.ServerID] = true
+			}
+
+			for _, h := range []string{i.Server.DDNS, i.Server.FQDN, i.Service.RelayDN, i.Service.RelayDualStack} {
+				if h != "" && h != "NULL" {
+					hosts[h] = true
+				}
+			}
+
+			addrs := []string{i.Server.External.IP, i.Server.External.IPv6, i.Server.Gateway, i.Service.RelayIP, i.Service.RelayIPv6, i.Service.HTTPSIP}
+
+			for _, ifc := range i.Server.Interface {
+				if !isLocalIP(ifc.IP) {
+					addrs = append(addrs, ifc.IP)
+				}
+
+				for _, a := range ifc.IPv6 {
+					if a.Scope != "link" {
+						addrs = append(addrs, a.Address)
+					}
+				}
+			}
+
+			for _, a := range addrs {
+				if ip := net.ParseIP(a); ip != nil && !ip.IsUnspecified() {
+					ips[a] = true
+				}
+			}
+		}
+	}
+
+	var pairs []string
+
+	for i, id := range sortedKeys(ids) {
+		redacted := fmt.Sprintf("%09d", i+1)
+		pairs = append(pairs,
+			`"`+id+`"`, `"`+redacted+`"`,
+			fmt.Sprintf("%x", md5.Sum([]byte(id))), fmt.Sprintf("%x", md5.Sum([]byte(redacted))))
+	}
+
+	for i, h := range sortedKeys(hosts) {
+		pairs = append(pairs, h, fmt.Sprintf("host%d.invalid", i+1))
+	}
+
+	addrs := make(map[string]string, len(ips))
+
+	for i, a := range sortedKeys(ips) {
+		if strings.Contains(a, ":") {
+			addrs[a] = fmt.Sprintf("2001:db8::%x", i+1)
+		} else {
+			addrs[a] = fmt.Sprintf("203.0.113.%d", i+1)
+		}
+	}
+
+	// The replacer tries values in order, so longer values go first in
+	// case one name is a prefix of another (eg. nas.example.com and
+	// nas.example.com.au)
+	sort.Stable(byOldLength(pairs))
+
+	rep := strings.NewReplacer(pairs...)
+
+	redact := func(s string) string {
+		return rep.Replace(replaceAddrs(s, addrs))
+	}
+
+	f := make(Fixture, len(r.exchanges))
+
+	for k, e := range r.exchanges {
+		e.Body = redact(e.Body)
+		f[redact(k)] = e
+	}
+
+	return f
+}
+
+// WriteFixture writes the redacted Fixture to w as JSON.
+func (r *Recorder) WriteFixture(w io.Writer) error {
+	return r.Fixture().Write(w)
+}
+
+// ReplayTransport is an http.RoundTripper which answers requests from
+// a Fixture instead of the network, waiting out each recorded delay.
+// Requests with no exchange in the Fixture fail.
+type ReplayTransport struct {
+	Fixture Fixture
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	key, err := fixtureKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := t.Fixture[key]
+	if !ok {
+		// fall back to plain URL for fixtures written by hand
+		e, ok = t.Fixture[req.URL.String()]
+	}
+
+	if !ok {
+		return nil, errors.New("unknown URL: no response in fixture")
+	}
+
+	if e.Delay > 0 {
+		timer := time.NewTimer(time.Duration(e.Delay*1000) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	if e.Error != "" {
+		return nil, errors.New(e.Error)
+	}
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode: e.Status,
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(e.Body)),
+		Request:    req,
+	}, nil
+}
+
+// fixtureKey returns the Fixture key for req, reading the command from
+// the body of control server requests.
+func fixtureKey(req *http.Request) (string, error) {
+
+	key := req.URL.String()
+
+	if req.Method != http.MethodPost || req.Body == nil {
+		return key, nil
+	}
+
+	var body []byte
+	var err error
+
+	if req.GetBody != nil {
+		var rc io.ReadCloser
+
+		rc, err = req.GetBody()
+		if err != nil {
+			return "", err
+		}
+
+		body, err = ioutil.ReadAll(rc)
+		rc.Close()
+	} else {
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	var cmds []Request
+
+	if json.Unmarshal(body, &cmds) == nil && len(cmds) > 0 && cmds[0].Command != CmdGetServerInfo {
+		key += "#" + cmds[0].Command
+	}
+
+	return key, nil
+}
+
+// replaceAddrs replaces the IP addresses in s that are keys of addrs
+// with their values. Only whole addresses are replaced, optionally
+// followed by a port in the case of IPv4, so that 10.0.0.1 is not
+// replaced within 10.0.0.10.
+func replaceAddrs(s string, addrs map[string]string) string {
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && isAddrChar(s[j]) {
+			j++
+		}
+
+		if j == i {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		run := s[i:j]
+
+		if a, ok := addrs[run]; ok {
+			run = a
+		} else if k := strings.IndexByte(run, ':'); k > 0 && strings.Contains(run[:k], ".") {
+			if a, ok := addrs[run[:k]]; ok {
+				run = a + run[k:]
+			}
+		}
+
+		b.WriteString(run)
+		i = j
+	}
+
+	return b.String()
+}
+
+func isAddrChar(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' || c == '.' || c == ':'
+}
+
+// byOldLength sorts strings.Replacer pairs by decreasing length of the
+// value replaced.
+type byOldLength []string
+
+func (p byOldLength) Len() int           { return len(p) / 2 }
+func (p byOldLength) Less(i, j int) bool { return len(p[2*i]) > len(p[2*j]) }
+func (p byOldLength) Swap(i, j int) {
+	p[2*i], p[2*j] = p[2*j], p[2*i]
+	p[2*i+1], p[2*j+1] = p[2*j+1], p[2*i+1]
+}
+
+func seconds(d time.Duration) float32 {
+	return float32(d) / float32(time.Second)
+}
+
+func sortedKeys(m map[string]bool) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,136 @@
+package qcon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+
+	defer setZones("eth0")()
+
+	rec := &Recorder{
+		Transport: &ReplayTransport{
+			Fixture: Fixture{
+				defaultServURL:                         {Status: 200, Body: testServResp},
+				"https://10.20.1.100:5001" + pingPath:  {Status: 200, Body: testPingSuccess, Delay: 0.1},
+				"http://10.20.1.100:5000" + pingPath:   {Status: 200, Body: testPingSuccess},
+				"https://75.66.42.168:5001" + pingPath: {Status: 200, Body: testPingInvalid},
+			},
+		},
+	}
+
+	c := Client{
+		Client:  &http.Client{Transport: rec},
+		Timeout: 500 * time.Millisecond,
+	}
+
+	exp, err := c.Resolve(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if err := rec.WriteFixture(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"030344165", "36e618cde8a29a8a8ef945ae21402312", "75.66.42.168", "10.20.1.1\"", "fd5e:fa6f:11df::100"} {
+		if strings.Contains(buf.String(), s) {
+			t.Errorf("fixture contains unredacted %s", s)
+		}
+	}
+
+	f, err := LoadFixture(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := f["https://10.20.1.100:5001"+pingPath]; e.Delay < 0.1 {
+		t.Errorf("recorded delay too short: %f", e.Delay)
+	}
+
+	// Addresses are numbered in order: the gateway, external IPv4 and
+	// the two global interface IPv6 addresses
+	if e := f["https://[2001:db8::4]:5001"+pingPath]; e.Error == "" {
+		t.Error("failed ping not recorded")
+	}
+
+	if _, ok := f["https://203.0.113.2:5001"+pingPath]; !ok {
+		t.Error("WAN ping not recorded under redacted address")
+	}
+
+	// Replaying gives the same result
+	c.Client = &http.Client{Transport: &ReplayTransport{Fixture: f}}
+
+	urls, err := c.Resolve(context.Background(), "foo")
+	if err != nil || !reflect.DeepEqual(urls, exp) {
+		t.Errorf("unexpected replay result %v (%v), expected %v", urls, err, exp)
+	}
+
+	// Public interface addresses and gateways are redacted too
+	body := strings.Replace(testServResp, `"gateway":"10.20.1.1"`, `"gateway":"75.66.42.1"`, -1)
+	body = strings.Replace(body, `"ip":"10.20.1.100"`, `"ip":"75.66.42.100"`, -1)
+	body = strings.Replace(body, "fd5e:fa6f:11df::100", "2a02:1234:5678::100", -1)
+
+	rec = &Recorder{
+		Transport: &ReplayTransport{
+			Fixture: Fixture{defaultServURL: {Status: 200, Body: body}},
+		},
+	}
+
+	c.Client = &http.Client{Transport: rec}
+	c.GetInfo(context.Background(), "foo")
+
+	buf.Reset()
+
+	if err := rec.WriteFixture(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"75.66.42.1", "2a02:1234:5678::100"} {
+		if strings.Contains(buf.String(), s) {
+			t.Errorf("fixture contains unredacted %s", s)
+		}
+	}
+
+	if !strings.Contains(buf.String(), "fe80::211:32ff:ef63:bca8") {
+		t.Error("link-local address redacted")
+	}
+}
+
+func TestRecorderRedactsRelay(t *testing.T) {
+
+	tunResp := strings.Replace(testServResp, `"pingpong":"DISCONNECTED"`, `"pingpong":"DISCONNECTED",`+testRelay, -1)
+
+	rec := &Recorder{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(tunResp))}, nil
+		}),
+	}
+
+	resp, err := (&http.Client{Transport: rec}).Get(defaultServURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+
+	if err := rec.WriteFixture(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"89.187.18.191", "2b02:9df0:c80d::84", "xxxx.yyyy", "75.66.42.168"} {
+		if strings.Contains(buf.String(), s) {
+			t.Errorf("fixture contains unredacted %s", s)
+		}
+	}
+}
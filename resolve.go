@@ -2,12 +2,14 @@ package qcon
 
 import (
 	"context"
+	"time"
 )
 
 // Resolve returns a list of URL strings for accessing the server
 // using the provided QuickConnect ID. The URL strings are in
 // ranked order, most preferred first and only those with verified
-// connectivity are returned.
+// connectivity are returned. The ID may be given in any form
+// accepted by ParseID.
 //
 // Resolve is a wrapper to (Client) Resolve() using DefaultClient
 func Resolve(ctx context.Context, id string) ([]string, error) {
@@ -19,30 +21,161 @@ func Resolve(ctx context.Context, id string) ([]string, error) {
 // Resolve returns a list of URL strings for accessing the server
 // using the provided QuickConnect ID. The URL strings are in
 // ranked order, most preferred first and only those with verified
-// connectivity are returned.
+// connectivity are returned. Relay tunnel routes are only included if
+// UseTunnel is set (see Client).
 func (c Client) Resolve(ctx context.Context, id string) ([]string, error) {
 
-	info, err := c.GetInfo(ctx, id)
+	res, err := c.ResolveDetailed(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.UpdateState(ctx, &info)
+	return res.URLs(), nil
+}
+
+// Resolution is the detailed outcome of resolving a QuickConnect ID.
+type Resolution struct {
+	Best    Record    // highest ranked verified Record
+	Records []Record  // all verified Records, in ranked order
+	Info    Info      // device info, with the tested State and Err of every Record
+	Tunnel  bool      // whether a tunnel was requested (see Client.UseTunnel)
+	Start   time.Time // when resolution started
+	End     time.Time // when testing finished
+}
+
+// URLs returns the URLs of the verified Records in ranked order.
+func (res *Resolution) URLs() []string {
+
+	urls := make([]string, len(res.Records))
+
+	for i, r := range res.Records {
+		urls[i] = r.URL
+	}
+
+	return urls
+}
+
+// Duration returns the time taken to resolve.
+func (res *Resolution) Duration() time.Duration {
+	return res.End.Sub(res.Start)
+}
+
+// ResolveDetailed is a wrapper to (Client) ResolveDetailed() using
+// DefaultClient.
+func ResolveDetailed(ctx context.Context, id string) (*Resolution, error) {
+
+	c := DefaultClient
+	return c.ResolveDetailed(ctx, id)
+}
+
+// ResolveDetailed resolves the given QuickConnect ID like Resolve, but
+// returns a Resolution describing the result in full. If the device info
+// was retrieved but no Record could be verified (or the device is
+// offline), the Resolution is returned along with the error so the
+// failures can be examined.
+func (c Client) ResolveDetailed(ctx context.Context, id string) (*Resolution, error) {
+
+	start := time.Now()
+
+	info, err := c.GetInfo(ctx, id)
+	if err != nil {
+		if info.ServerID == "" {
+			return nil, err
+		}
+		return &Resolution{Info: info, Start: start, End: time.Now()}, err
+	}
+
+	res, err := c.resolveDetailed(ctx, &info)
+	if res != nil {
+		res.Start = start
+	}
+
+	return res, err
+}
+
+// sharedTimeout bounds a resolution shared by several callers, which
+// runs on a context of its own rather than that of any one caller. It
+// allows for the control server requests and two rounds of pings.
+func (c Client) sharedTimeout() time.Duration {
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return 4*timeout + 10*time.Second
+}
+
+// resolveDetailed tests the Records of info, requesting a tunnel if none
+// are accessible and UseTunnel is set. Unless testing is cancelled, a
+// Resolution is returned even if no Record was verified (with
+// ErrCannotAccess).
+func (c Client) resolveDetailed(ctx context.Context, info *Info) (*Resolution, error) {
+
+	res := &Resolution{Start: time.Now()}
+
+	err := c.UpdateState(ctx, info)
 	if err != nil {
 		return nil, err
 	}
 
-	var urls []string
+	if c.UseTunnel && !accessible(info) && info.ID != "" {
+		res.Tunnel = true
+
+		err = c.tryTunnel(ctx, info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res.End = time.Now()
+	res.Info = *info
+
+	for _, r := range info.Records {
+		if r.State == StateOK {
+			res.Records = append(res.Records, r)
+		}
+	}
+
+	if len(res.Records) == 0 {
+		return res, ErrCannotAccess
+	}
+
+	res.Best = res.Records[0]
+
+	return res, nil
+}
+
+// accessible reports whether any Record of info has been verified.
+func accessible(info *Info) bool {
 
 	for _, r := range info.Records {
 		if r.State == StateOK {
-			urls = append(urls, r.URL)
+			return true
 		}
 	}
 
-	if len(urls) == 0 {
-		return nil, ErrCannotAccess
+	return false
+}
+
+// tryTunnel requests a tunnel to the device and tests the resulting
+// tunnel Records. A failure to set up the tunnel is not an error as
+// the device is simply inaccessible.
+func (c Client) tryTunnel(ctx context.Context, info *Info) error {
+
+	n := len(info.Records)
+
+	if c.RequestTunnel(ctx, info) != nil {
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		return nil
 	}
 
-	return urls, nil
+	// Tunnel Records have the lowest priority so were appended after
+	// the existing ones. Test only those, sharing the backing array so
+	// their states are updated in place.
+	tun := Info{ServerID: info.ServerID, Records: info.Records[n:]}
+
+	return c.UpdateState(ctx, &tun)
 }
@@ -2,16 +2,33 @@ package qcon
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
 
 var testID = flag.String("id", "", "QuickConnect ID")
 
+// setZones replaces the local interface lookup used for IPv6 link-local
+// addresses and returns a function restoring the original.
+func setZones(zones ...string) func() {
+	orig := interfaceZones
+	interfaceZones = func() []string { return zones }
+
+	return func() { interfaceZones = orig }
+}
+
 func TestGetInfo(t *testing.T) {
 
+	defer setZones("eth0")()
+
 	ctx := context.Background()
 
 	tr := &mockTransport{
@@ -36,7 +53,7 @@ func TestGetInfo(t *testing.T) {
 		ServerID: "030344165",
 		Records: []Record{
 			{URL: "https://10.20.1.100:5001", Type: httpsLanIPv4},
-			{URL: "https://[fe80::211:32ff:ef63:bca8]:5001", Type: httpsLanIPv6},
+			{URL: "https://[fe80::211:32ff:ef63:bca8%25eth0]:5001", Type: httpsLanIPv6},
 			{URL: "https://[fd5e:fa6f:11df:0:211:32ff:ef63:bca8]:50551", Type: httpsWanIPv6},
 			{URL: "https://[fd5e:fa6f:11df:0:211:32ff:ef63:bca8]:5001", Type: httpsWanIPv6},
 			{URL: "https://[fd5e:fa6f:11df::100]:50551", Type: httpsWanIPv6},
@@ -44,7 +61,7 @@ func TestGetInfo(t *testing.T) {
 			{URL: "https://75.66.42.168:50551", Type: httpsWanIPv4},
 			{URL: "https://75.66.42.168:5001", Type: httpsWanIPv4},
 			{URL: "http://10.20.1.100:5000", Type: httpLanIPv4},
-			{URL: "http://[fe80::211:32ff:ef63:bca8]:5000", Type: httpLanIPv6},
+			{URL: "http://[fe80::211:32ff:ef63:bca8%25eth0]:5000", Type: httpLanIPv6},
 			{URL: "http://[fd5e:fa6f:11df:0:211:32ff:ef63:bca8]:50550", Type: httpWanIPv6},
 			{URL: "http://[fd5e:fa6f:11df:0:211:32ff:ef63:bca8]:5000", Type: httpWanIPv6},
 			{URL: "http://[fd5e:fa6f:11df::100]:50550", Type: httpWanIPv6},
@@ -58,6 +75,23 @@ func TestGetInfo(t *testing.T) {
 		t.Errorf("unexpected ServerID:\n  exp: %s\n  got: %s\n", exp.ServerID, info.ServerID)
 	}
 
+	if info.HTTPS.Service.Port != 5001 || info.HTTP.Service.Port != 5000 {
+		t.Errorf("unexpected service ports: HTTPS %d, HTTP %d", info.HTTPS.Service.Port, info.HTTP.Service.Port)
+	}
+
+	srv := info.HTTPS.Server
+	if srv.Version != "24922" || srv.DSState != "CONNECTED" || srv.Gateway != "10.20.1.1" || srv.UDPPunchPort != 36810 {
+		t.Errorf("unexpected server details: %+v", srv)
+	}
+
+	if len(srv.Interface) != 1 || srv.Interface[0].Name != "eth0" || srv.Interface[0].Mask != "255.255.255.0" {
+		t.Errorf("unexpected interfaces: %+v", srv.Interface)
+	}
+
+	if info.HTTPS.Env.ControlHost != "usc.quickconnect.to" || info.HTTPS.Service.PingPong != "DISCONNECTED" {
+		t.Errorf("unexpected env/pingpong: %+v %s", info.HTTPS.Env, info.HTTPS.Service.PingPong)
+	}
+
 	if len(info.Records) != len(exp.Records) {
 		t.Fatalf("incorrect number of records returned: expected %d, got %d", len(exp.Records), len(info.Records))
 	}
@@ -73,6 +107,620 @@ func TestGetInfo(t *testing.T) {
 	}
 }
 
+func TestGetInfoZones(t *testing.T) {
+
+	tr := &mockTransport{
+		responses: map[string]response{
+			defaultServURL: {Status: 200, Body: testServResp},
+		},
+	}
+
+	c := Client{
+		Client: &http.Client{
+			Transport: tr,
+		},
+	}
+
+	// Link-local addresses are expanded once per local interface
+	restore := setZones("eth0", "wlan0")
+
+	info, err := c.GetInfo(context.Background(), "foo")
+	restore()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := []string{
+		"https://[fe80::211:32ff:ef63:bca8%25eth0]:5001",
+		"https://[fe80::211:32ff:ef63:bca8%25wlan0]:5001",
+	}
+
+	var got []string
+	for _, r := range info.Records {
+		if r.Type == httpsLanIPv6 {
+			got = append(got, r.URL)
+		}
+	}
+
+	if len(got) != len(exp) {
+		t.Fatalf("unexpected link-local URLs:\n  exp: %v\n  got: %v", exp, got)
+	}
+
+	for _, u := range exp {
+		found := false
+		for _, g := range got {
+			if g == u {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing link-local URL %s", u)
+		}
+	}
+
+	// Without a usable interface they are skipped with a reason
+	restore = setZones()
+
+	info, err = c.GetInfo(context.Background(), "foo")
+	restore()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, r := range info.Records {
+		if r.Type == httpsLanIPv6 || r.Type == httpLanIPv6 {
+			t.Errorf("unexpected link-local record: %s", r.URL)
+		}
+	}
+
+	if len(info.Skipped) != 2 {
+		t.Fatalf("expected 2 skipped addresses, got %d", len(info.Skipped))
+	}
+
+	for _, s := range info.Skipped {
+		if s.Reason != ErrNoZone {
+			t.Errorf("unexpected skip reason for %s: %v", s.Address, s.Reason)
+		}
+	}
+}
+
+func TestGetInfoExternalIPv6(t *testing.T) {
+
+	defer setZones("eth0")()
+
+	// Publish a delegated external address plus one duplicating an interface address
+	tests := []struct {
+		ext string
+		exp []string
+	}{
+		{"2001:db8:1::5", []string{"https://[2001:db8:1::5]:50551", "https://[2001:db8:1::5]:5001"}},
+		{"FD5E:FA6F:11DF::100", nil},
+		{"NULL", nil},
+		{"::", nil},
+	}
+
+	for _, tc := range tests {
+		body := strings.Replace(testServResp, `"ipv6":"::"`, `"ipv6":"`+tc.ext+`"`, -1)
+
+		c := Client{
+			Client: &http.Client{
+				Transport: &mockTransport{
+					responses: map[string]response{
+						defaultServURL: {Status: 200, Body: body},
+					},
+				},
+			},
+		}
+
+		info, err := c.GetInfo(context.Background(), "foo")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.ext, err)
+		}
+
+		var got []string
+		for _, r := range info.Records {
+			if r.Type == httpsWanIPv6 && !strings.Contains(r.URL, "fd5e:") {
+				got = append(got, r.URL)
+			}
+		}
+
+		if len(got) != len(tc.exp) {
+			t.Fatalf("%s: unexpected external IPv6 URLs:\n  exp: %v\n  got: %v", tc.ext, tc.exp, got)
+		}
+
+		for i := range got {
+			if got[i] != tc.exp[i] {
+				t.Errorf("%s: URL mismatch:\n  exp: %s\n  got: %s", tc.ext, tc.exp[i], got[i])
+			}
+		}
+	}
+}
+
+func TestGetInfoDuplicates(t *testing.T) {
+
+	defer setZones("eth0")()
+
+	// Interface address equal to the external address, and matching DDNS/FQDN names
+	body := strings.Replace(testServResp, `"ip":"10.20.1.100"`, `"ip":"75.66.42.168"`, -1)
+	body = strings.Replace(body, `"ddns":"NULL"`, `"ddns":"nas.example.com"`, -1)
+	body = strings.Replace(body, `"fqdn":"NULL"`, `"fqdn":"nas.example.com"`, -1)
+
+	c := Client{
+		Client: &http.Client{
+			Transport: &mockTransport{
+				responses: map[string]response{
+					defaultServURL: {Status: 200, Body: body},
+				},
+			},
+		},
+	}
+
+	info, err := c.GetInfo(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := map[string]Record{
+		"https://75.66.42.168:5001":     {Type: httpsWanIPv4, Sources: SourceInterface | SourceExternal},
+		"https://75.66.42.168:50551":    {Type: httpsWanIPv4, Sources: SourceExternal},
+		"https://nas.example.com:5001":  {Type: httpsFQDN, Sources: SourceFQDN | SourceDDNS},
+		"https://nas.example.com:50551": {Type: httpsFQDN, Sources: SourceFQDN | SourceDDNS},
+		"http://nas.example.com:5000":   {Type: httpFQDN, Sources: SourceFQDN | SourceDDNS},
+	}
+
+	seen := make(map[string]bool)
+
+	for _, r := range info.Records {
+		if seen[r.URL] {
+			t.Errorf("duplicate record: %s", r.URL)
+		}
+		seen[r.URL] = true
+
+		e, ok := exp[r.URL]
+		if !ok {
+			continue
+		}
+
+		if r.Type != e.Type {
+			t.Errorf("%s: unexpected Type: exp: %d, got: %d", r.URL, e.Type, r.Type)
+		}
+
+		if r.Sources != e.Sources {
+			t.Errorf("%s: unexpected Sources: exp: %s, got: %s", r.URL, e.Sources, r.Sources)
+		}
+	}
+
+	for u := range exp {
+		if !seen[u] {
+			t.Errorf("missing record: %s", u)
+		}
+	}
+}
+
+// fakeResolver answers hostname lookups from a fixed table.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := f[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return addrs, nil
+}
+
+func TestGetInfoResolver(t *testing.T) {
+
+	defer setZones("eth0")()
+
+	body := strings.Replace(testServResp, `"fqdn":"NULL"`, `"fqdn":"nas.example.com"`, -1)
+	body = strings.Replace(body, `"ddns":"NULL"`, `"ddns":"stale.example.com"`, -1)
+
+	c := Client{
+		Client: &http.Client{
+			Transport: &mockTransport{
+				responses: map[string]response{
+					defaultServURL: {Status: 200, Body: body},
+				},
+			},
+		},
+		Resolver: fakeResolver{
+			"nas.example.com": {"203.0.113.7", "203.0.113.8", "2001:db8::7"},
+		},
+	}
+
+	info, err := c.GetInfo(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := []Record{
+		{URL: "https://[2001:db8::7]:50551", ServerName: "nas.example.com"},
+		{URL: "https://203.0.113.7:50551", ServerName: "nas.example.com"},
+		{URL: "https://203.0.113.8:50551", ServerName: "nas.example.com"},
+		{URL: "https://[2001:db8::7]:5001", ServerName: "nas.example.com"},
+		{URL: "https://203.0.113.7:5001", ServerName: "nas.example.com"},
+		{URL: "https://203.0.113.8:5001", ServerName: "nas.example.com"},
+	}
+
+	var got []Record
+	for _, r := range info.Records {
+		if r.Type == httpsFQDN {
+			got = append(got, r)
+		}
+	}
+
+	if len(got) != len(exp) {
+		t.Fatalf("unexpected number of FQDN records: expected %d, got %d", len(exp), len(got))
+	}
+
+	for i := range got {
+		if got[i].URL != exp[i].URL || got[i].ServerName != exp[i].ServerName {
+			t.Errorf("record %d mismatch:\n  exp: %s (%s)\n  got: %s (%s)", i, exp[i].URL, exp[i].ServerName, got[i].URL, got[i].ServerName)
+		}
+	}
+
+	// Names that fail to resolve are left for net/http to handle
+	found := false
+	for _, r := range info.Records {
+		if r.URL == "https://stale.example.com:5001" && r.Type == httpsDDNS {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Error("unresolved DDNS record missing")
+	}
+}
+
+func TestInfoAddMerge(t *testing.T) {
+
+	const u = "https://203.0.113.7:5001"
+
+	tests := []struct {
+		name  string
+		recs  []Record
+		exp   uint8
+		expSN string
+	}{
+		{"lower priority name ignored", []Record{
+			{URL: u, Type: httpsFQDN, ServerName: "nas.example.com"},
+			{URL: u, Type: httpsDDNS, ServerName: "nas.example.net"},
+		}, httpsFQDN, "nas.example.com"},
+		{"lower priority without name", []Record{
+			{URL: u, Type: httpsFQDN, ServerName: "nas.example.com"},
+			{URL: u, Type: httpsWanIPv4},
+		}, httpsFQDN, "nas.example.com"},
+		{"lower priority fills missing name", []Record{
+			{URL: u, Type: httpsWanIPv4},
+			{URL: u, Type: httpsWanIPv4, ServerName: "nas.example.net"},
+		}, httpsWanIPv4, "nas.example.net"},
+		{"higher priority name taken", []Record{
+			{URL: u, Type: httpsDDNS, ServerName: "nas.example.net"},
+			{URL: u, Type: httpsFQDN, ServerName: "nas.example.com"},
+		}, httpsFQDN, "nas.example.com"},
+		{"higher priority without name", []Record{
+			{URL: u, Type: httpsDDNS, ServerName: "nas.example.net"},
+			{URL: u, Type: httpsFQDN},
+		}, httpsFQDN, "nas.example.net"},
+	}
+
+	for _, tc := range tests {
+		var info Info
+
+		for _, r := range tc.recs {
+			info.add(r)
+		}
+
+		if len(info.Records) != 1 || info.Records[0].Type != tc.exp || info.Records[0].ServerName != tc.expSN {
+			t.Errorf("%s: unexpected records %+v", tc.name, info.Records)
+		}
+	}
+}
+
+func TestPingServerName(t *testing.T) {
+
+	var host string
+
+	c := Client{
+		Client: &http.Client{
+			Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				host = req.Host
+				return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(testPingSuccess))}, nil
+			}),
+		},
+	}
+
+	_, _, err := c.ping(context.Background(), Record{URL: "https://203.0.113.7:5001", ServerName: "nas.example.com"}, testServerID)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if host != "nas.example.com:5001" {
+		t.Errorf("unexpected Host header: %s", host)
+	}
+
+	hc, done := Client{}.probeClient(Record{URL: "https://203.0.113.7:5001", ServerName: "nas.example.com"}, "")
+	defer done()
+
+	if tr, ok := hc.Transport.(*http.Transport); !ok || tr.TLSClientConfig.ServerName != "nas.example.com" {
+		t.Error("TLS server name not set on cloned transport")
+	}
+}
+
+func TestUpdateStateStagger(t *testing.T) {
+
+	defer setZones("eth0")()
+
+	// The top priority URL answers last but should still win and end probing early
+	tr := &mockTransport{
+		responses: map[string]response{
+			defaultServURL:                         {Status: 200, Body: testServResp},
+			"https://10.20.1.100:5001" + pingPath:  {Status: 200, Body: testPingSuccess, Delay: 0.3},
+			"https://75.66.42.168:5001" + pingPath: {Status: 200, Body: testPingSuccess},
+			"http://75.66.42.168:5000" + pingPath:  {Status: 200, Body: testPingSuccess, Delay: 1.5},
+		},
+	}
+
+	c := Client{
+		Client: &http.Client{
+			Transport: tr,
+		},
+		Timeout: 2 * time.Second,
+		Stagger: 20 * time.Millisecond,
+	}
+
+	ctx := context.Background()
+
+	info, err := c.GetInfo(ctx, "foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	start := time.Now()
+
+	err = c.UpdateState(ctx, &info)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("probing did not stop early: took %s", d)
+	}
+
+	for _, r := range info.Records {
+		switch r.URL {
+		case "https://10.20.1.100:5001":
+			if r.State != StateOK {
+				t.Errorf("%s: expected StateOK, got %d", r.URL, r.State)
+			}
+		case "http://75.66.42.168:5000":
+			if r.State != StateUnknown {
+				t.Errorf("%s: expected cancelled probe, got state %d", r.URL, r.State)
+			}
+		}
+	}
+}
+
+func TestProbeOrder(t *testing.T) {
+
+	recs := []Record{
+		{URL: "https://10.0.0.1:5001"},
+		{URL: "https://[fe80::1%25eth0]:5001"},
+		{URL: "https://[2001:db8::1]:5001"},
+		{URL: "https://nas.example.com:5001"},
+		{URL: "https://203.0.113.1:5001"},
+	}
+
+	exp := []int{0, 1, 3, 2, 4}
+	got := probeOrder(recs)
+
+	if len(got) != len(exp) {
+		t.Fatalf("unexpected order length: expected %d, got %d", len(exp), len(got))
+	}
+
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("unexpected order:\n  exp: %v\n  got: %v", exp, got)
+		}
+	}
+}
+
+// lookupFunc adapts a function to the HostResolver interface.
+type lookupFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+func (f lookupFunc) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return f(ctx, host)
+}
+
+func TestGetInfoOffline(t *testing.T) {
+
+	body := strings.Replace(testServResp, `"ds_state":"CONNECTED"`, `"ds_state":"DISCONNECTED"`, -1)
+	body = strings.Replace(body, `"fqdn":"NULL"`, `"fqdn":"nas.example.com"`, -1)
+
+	c := Client{
+		Client: &http.Client{
+			Transport: &mockTransport{
+				responses: map[string]response{
+					defaultServURL:                        {Status: 200, Body: body},
+					"https://10.20.1.100:5001" + pingPath: {Status: 200, Body: testPingSuccess},
+				},
+			},
+		},
+		Timeout: 200 * time.Millisecond,
+	}
+
+	_, err := c.Resolve(context.Background(), "foo")
+	if !errors.Is(err, ErrDeviceOffline) {
+		t.Fatalf("expected ErrDeviceOffline, got %v", err)
+	}
+
+	var oe *OfflineError
+	if !errors.As(err, &oe) || oe.State != "DISCONNECTED" || oe.PingPong != "DISCONNECTED" {
+		t.Errorf("unexpected offline error: %#v", err)
+	}
+
+	// No lookups are made for a device known to be offline
+	lookups := 0
+	c.Resolver = lookupFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		return nil, errors.New("no such host")
+	})
+
+	if _, err := c.GetInfo(context.Background(), "foo"); !errors.Is(err, ErrDeviceOffline) || lookups != 0 {
+		t.Errorf("expected ErrDeviceOffline without lookups, got %v after %d lookups", err, lookups)
+	}
+
+	c.Resolver = nil
+
+	// The server's view may be stale, so allow resolving regardless
+	c.IgnoreOffline = true
+
+	urls, err := c.Resolve(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(urls) != 1 || urls[0] != "https://10.20.1.100:5001" {
+		t.Errorf("unexpected URLs: %v", urls)
+	}
+}
+
+func TestQuery(t *testing.T) {
+
+	var body []map[string]interface{}
+
+	c := Client{
+		Client: &http.Client{
+			Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					return nil, err
+				}
+				return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`[{"errno":0},{"errno":0},{"errno":4}]`))}, nil
+			}),
+		},
+	}
+
+	reqs := []Request{
+		{Version: 1, Command: CmdGetServerInfo, ID: PortalDSMHTTPS, ServerID: `a"b`},
+		{Version: 1, Command: CmdGetServerInfo, ID: PortalDSM, ServerID: "foo", StopWhenSuccess: true},
+		{Version: 2, Command: CmdRequestTunnel, ID: PortalPhotoHTTPS, ServerID: "foo", IsGofile: true},
+	}
+
+	info, err := c.Query(context.Background(), reqs...)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(info) != 3 || info[2].ErrNo != 4 {
+		t.Errorf("unexpected responses: %+v", info)
+	}
+
+	if len(body) != 3 {
+		t.Fatalf("expected 3 requests in body, got %d", len(body))
+	}
+
+	if body[0]["serverID"] != `a"b` || body[1]["stop_when_success"] != true || body[2]["is_gofile"] != true || body[2]["version"] != 2.0 {
+		t.Errorf("unexpected request body: %v", body)
+	}
+
+	for _, r := range body {
+		for _, k := range []string{"version", "command", "stop_when_error", "stop_when_success", "id", "serverID", "is_gofile"} {
+			if _, ok := r[k]; !ok {
+				t.Errorf("request missing field %s: %v", k, r)
+			}
+		}
+	}
+}
+
+func TestResolveTunnel(t *testing.T) {
+
+	defer setZones("eth0")()
+
+	tunResp := strings.Replace(testServResp, `"command":"get_server_info"`, `"command":"request_tunnel"`, -1)
+	tunResp = strings.Replace(tunResp, `"pingpong":"DISCONNECTED"`, `"pingpong":"DISCONNECTED",`+testRelay, -1)
+
+	// No direct route answers, so the relay routes are requested and tested
+	tr := &ReplayTransport{
+		Fixture: Fixture{
+			defaultServURL:                                           {Status: 200, Body: testServResp},
+			defaultServURL + "#request_tunnel":                       {Status: 200, Body: tunResp},
+			"https://usr5.xxxx.yyyy.quickconnect.to:2905" + pingPath: {Status: 200, Body: testPingSuccess},
+			"https://89.187.18.191:2905" + pingPath:                  {Status: 200, Body: testPingSuccess},
+			"https://89.187.18.191:443" + pingPath:                   {Status: 200, Body: testPingSuccess},
+			"http://89.187.18.191:2905" + pingPath:                   {Status: 200, Body: testPingSuccess},
+		},
+	}
+
+	exp := []string{
+		"https://usr5.xxxx.yyyy.quickconnect.to:2905", // httpsTunDN
+		"https://89.187.18.191:2905",                  // httpsTun
+		"https://89.187.18.191:443",                   // httpsTunHTTPS
+		"http://89.187.18.191:2905",                   // httpTun
+	}
+
+	c := Client{Client: &http.Client{Transport: tr}, Timeout: 500 * time.Millisecond}
+
+	// Tunnels are only requested when enabled
+	if urls, err := c.Resolve(context.Background(), "foo"); err != ErrCannotAccess {
+		t.Errorf("expected ErrCannotAccess without UseTunnel, got %v %v", urls, err)
+	}
+
+	c.UseTunnel = true
+
+	urls, err := c.Resolve(context.Background(), "foo")
+	if err != nil || !reflect.DeepEqual(urls, exp) {
+		t.Errorf("unexpected URLs %v (%v), expected %v", urls, err, exp)
+	}
+
+	info, err := c.GetInfo(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range info.Records {
+		if isTunnel(r.Type) {
+			t.Errorf("unexpected tunnel record before requesting tunnel: %s", r.URL)
+		}
+	}
+
+	if err := c.RequestTunnel(context.Background(), &info); err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]uint8)
+	for _, r := range info.Records {
+		if isTunnel(r.Type) {
+			types[r.URL] = r.Type
+		}
+	}
+
+	expTypes := map[string]uint8{
+		"https://usrds5.xxxx.yyyy.quickconnect.to:2905": httpsTunDualStack,
+		"https://usr5.xxxx.yyyy.quickconnect.to:2905":   httpsTunDN,
+		"https://89.187.18.191:2905":                    httpsTun,
+		"https://[2b02:9df0:c80d::84]:2905":             httpsTun,
+		"https://89.187.18.191:443":                     httpsTunHTTPS,
+		"http://89.187.18.191:2905":                     httpTun,
+		"http://[2b02:9df0:c80d::84]:2905":              httpTun,
+	}
+
+	if len(types) != len(expTypes) {
+		t.Errorf("unexpected tunnel records: %v", types)
+	}
+
+	for u, typ := range expTypes {
+		if got, ok := types[u]; !ok || got != typ {
+			t.Errorf("%s: expected type %d, got %d (present %t)", u, typ, got, ok)
+		}
+	}
+}
+
 // TestLiveResolve will test against Synology central server
 // using the QuickConnectID passed in the -id option to go test.
 // If no ID option is present, this test will be skipped.
@@ -91,6 +739,76 @@ func TestLiveResolve(t *testing.T) {
 	t.Logf("%+v\n", urls)
 }
 
+func TestResolveDetailed(t *testing.T) {
+
+	defer setZones()()
+
+	tr := &mockTransport{
+		responses: map[string]response{
+			defaultServURL:                         {Status: 200, Body: testServResp},
+			"https://10.20.1.100:5001" + pingPath:  {Status: 200, Body: testPingInvalid},
+			"https://75.66.42.168:5001" + pingPath: {Status: 200, Body: testPingSuccess},
+			"http://10.20.1.100:5000" + pingPath:   {Status: 200, Body: testPingSuccess},
+		},
+	}
+
+	c := Client{
+		Client:  &http.Client{Transport: tr},
+		Timeout: 500 * time.Millisecond,
+	}
+
+	res, err := c.ResolveDetailed(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Best.URL != "https://75.66.42.168:5001" || res.Best.Type != httpsWanIPv4 {
+		t.Errorf("unexpected best record: %+v", res.Best)
+	}
+
+	exp := []string{"https://75.66.42.168:5001", "http://10.20.1.100:5000"}
+	if urls := res.URLs(); !reflect.DeepEqual(urls, exp) {
+		t.Errorf("unexpected URLs: %v", urls)
+	}
+
+	if res.Tunnel || res.Info.ServerID != testServerID || res.End.Before(res.Start) {
+		t.Errorf("unexpected resolution: %+v", res)
+	}
+
+	for _, r := range res.Info.Records {
+		if r.URL != "https://10.20.1.100:5001" {
+			continue
+		}
+
+		var pe *PingError
+		if r.State != StateInvalidServer || !errors.As(r.Err, &pe) || pe.Kind != PingIdentity {
+			t.Errorf("unexpected result for %s: state %d, err %v", r.URL, r.State, r.Err)
+		}
+	}
+
+	// With nothing accessible a tunnel is tried, and the failed
+	// resolution is still returned
+	delete(tr.responses, "https://75.66.42.168:5001"+pingPath)
+	delete(tr.responses, "http://10.20.1.100:5000"+pingPath)
+
+	c.UseTunnel = true
+
+	res, err = c.ResolveDetailed(context.Background(), "foo")
+	if err != ErrCannotAccess {
+		t.Fatalf("expected ErrCannotAccess, got %v", err)
+	}
+
+	if res == nil || !res.Tunnel || len(res.Records) != 0 || len(res.Info.Records) == 0 {
+		t.Fatalf("unexpected resolution: %+v", res)
+	}
+
+	for _, r := range res.Info.Records {
+		if r.State != StateOK && r.State != StateUnknown && r.Err == nil {
+			t.Errorf("%s: state %d without error", r.URL, r.State)
+		}
+	}
+}
+
 // helper function for comparing results of resolve tests.
 func runResolveTest(t *testing.T, tr *mockTransport, exp []string) {
 	t.Helper()
@@ -10,155 +10,214 @@ import (
 
 // fetching and decoding responses from http://global.quickconnect.to/Serv.php
 
-// JSON response
-type serverInfo struct {
-	Command string
-	// Env     json.RawMessage
-	ErrNo   int
-	Service service
-	Server  server
+// ServerInfo is one element of a get_server_info or request_tunnel
+// response, describing the device for either HTTPS or HTTP access.
+type ServerInfo struct {
+	Command  string  `json:"command"`
+	Env      Env     `json:"env"`
+	ErrNo    int     `json:"errno"`
+	SubErrNo int     `json:"suberrno,omitempty"`
+	Server   Server  `json:"server"`
+	Service  Service `json:"service"`
+	Version  int     `json:"version"`
 }
 
-// Service
-type service struct {
-	Port    int
-	ExtPort int `json:"ext_port"`
-	// PingPong     string
-	// PingPongDesc json.RawMessage
+// Env describes the QuickConnect infrastructure serving the device.
+type Env struct {
+	ControlHost string `json:"control_host"`
+	RelayRegion string `json:"relay_region"`
+}
+
+// Service holds the ports of the requested DSM service along with
+// tunnel details, which are only present in request_tunnel responses.
+type Service struct {
+	Port         int             `json:"port"`
+	ExtPort      int             `json:"ext_port"`
+	PingPong     string          `json:"pingpong"`
+	PingPongDesc json.RawMessage `json:"pingpong_desc,omitempty"`
 
 	// HTTPS Tunnel Info (not always present)
-	RelayIP   string `json:"relay_ip"`
-	RelayIPv6 string `json:"relay_ipv6"`
-	// RelayDualStack string `json:"relay_dualstack"`
-	// RelayDn string `json:"relay_dn"`
-	RelayPort int    `json:"relay_port"`
-	HttpsIP   string `json:"https_ip"`
-	HttpsPort int    `json:"https_port"`
+	RelayIP        string `json:"relay_ip,omitempty"`
+	RelayIPv6      string `json:"relay_ipv6,omitempty"`
+	RelayDualStack string `json:"relay_dualstack,omitempty"`
+	RelayDN        string `json:"relay_dn,omitempty"`
+	RelayPort      int    `json:"relay_port,omitempty"`
+	HTTPSIP        string `json:"https_ip,omitempty"`
+	HTTPSPort      int    `json:"https_port,omitempty"`
 }
 
-// Server info
-type server struct {
-	DDNS string
-	FQDN string
-	// Gateway   string
-	External  extIPs
-	Interface []iface
-
-	ServerID string `json:"serverID"`
-	// TCPPunchPort  int    `json:"tcp_punch_port"`
-	// UUDPPunchPort int    `json:"udp_punch_port"`
-	// Version       string
+// Server describes the device and its network configuration. Unset
+// string fields are commonly reported as "NULL".
+type Server struct {
+	DDNS         string          `json:"ddns"`
+	DSState      string          `json:"ds_state"`
+	External     External        `json:"external"`
+	FQDN         string          `json:"fqdn"`
+	Gateway      string          `json:"gateway"`
+	Interface    []Interface     `json:"interface"`
+	IPv6Tunnel   json.RawMessage `json:"ipv6_tunnel,omitempty"`
+	ServerID     string          `json:"serverID"`
+	TCPPunchPort int             `json:"tcp_punch_port"`
+	UDPPunchPort int             `json:"udp_punch_port"`
+	Version      string          `json:"version"` // DSM build number
 }
 
-type extIPs struct {
-	IP   string
-	IPv6 string
+// External holds the public addresses of the device as seen by the
+// QuickConnect server.
+type External struct {
+	IP   string `json:"ip"`
+	IPv6 string `json:"ipv6"`
 }
 
-// Server interface
-type iface struct {
-	IP   string
-	IPv6 []ipv6
-	// IPv6Tunnel    []json.RawMessage `json:"ipv6_tunnel"`
-	// Mask string
-	// Name string
+// Interface is a network interface of the device.
+type Interface struct {
+	IP   string        `json:"ip"`
+	IPv6 []IPv6Address `json:"ipv6"`
+	Mask string        `json:"mask"`
+	Name string        `json:"name"`
 }
 
-// IPv6 address
-type ipv6 struct {
-	// AddrType     int `json:"addr_type"`
-	Address string
-	// PrefixLength int `json:"prefix_length"`
-	Scope string
+// IPv6Address is an IPv6 address of an Interface. Scope is "link" for
+// link-local addresses.
+type IPv6Address struct {
+	AddrType     int    `json:"addr_type"`
+	Address      string `json:"address"`
+	PrefixLength int    `json:"prefix_length"`
+	Scope        string `json:"scope"`
 }
 
-// commands are either 'get_server_info' or 'request_tunnel'
-// ids are 'dsm_portal_https', 'dsm_portal', 'photo_portal_https' or 'photo_portal_http'
-
-const serverQuery = `[
-  {
-    "version": 1,
-    "command": "%s",
-    "stop_when_error": false,
-    "stop_when_success": false,
-    "id": "%s",
-    "serverID": "%s",
-    "is_gofile": false
-  },
-  {
-    "version": 1,
-    "command": "%s",
-    "stop_when_error": false,
-    "stop_when_success": false,
-    "id": "%s",
-    "serverID": "%s",
-    "is_gofile": false
-  }
-]`
-
-// QueryURL is URL for global QuickConnect configuration server
-//var QueryURL string = "http://global.quickconnect.to/Serv.php"
-
-// newRequestBody returns the JSON encoded body for a request to the server
-func newRequestBody(cmd, typ, serverID string) (*bytes.Buffer, error) {
-
-	var b *bytes.Buffer
-
-	if cmd != "get_server_info" && cmd != "request_tunnel" {
+// Control server commands
+const (
+	CmdGetServerInfo = "get_server_info"
+	CmdRequestTunnel = "request_tunnel"
+)
+
+// Portal IDs identifying the service a Request is for
+const (
+	PortalDSMHTTPS   = "dsm_portal_https"
+	PortalDSM        = "dsm_portal"
+	PortalPhotoHTTPS = "photo_portal_https"
+	PortalPhotoHTTP  = "photo_portal_http"
+)
+
+// Request is a single request to the QuickConnect control server.
+// Several Requests may be sent in one query, each receiving its own
+// ServerInfo in the response.
+type Request struct {
+	Version         int    `json:"version"`
+	Command         string `json:"command"`
+	StopWhenError   bool   `json:"stop_when_error"`
+	StopWhenSuccess bool   `json:"stop_when_success"`
+	ID              string `json:"id"`
+	ServerID        string `json:"serverID"`
+	IsGofile        bool   `json:"is_gofile"`
+}
+
+// newRequests returns the pair of HTTPS and HTTP requests for command
+// cmd on the given server type ("dsm" or "photo").
+func newRequests(cmd, typ, serverID string) ([]Request, error) {
+
+	var portals [2]string
+
+	if cmd != CmdGetServerInfo && cmd != CmdRequestTunnel {
 		return nil, ErrUnknownCommand
 	}
 
-	// TODO: validate serverID
-
 	switch typ {
 	case "dsm":
-		b = bytes.NewBufferString(fmt.Sprintf(serverQuery, cmd, "dsm_portal_https", serverID, cmd, "dsm_portal", serverID))
+		portals = [2]string{PortalDSMHTTPS, PortalDSM}
 
 	case "photo":
-		b = bytes.NewBufferString(fmt.Sprintf(serverQuery, cmd, "photo_portal_https", serverID, cmd, "photo_portal_http", serverID))
+		portals = [2]string{PortalPhotoHTTPS, PortalPhotoHTTP}
 
 	default:
 		return nil, ErrUnknownServerType
 	}
 
-	return b, nil
+	reqs := make([]Request, len(portals))
+
+	for i, p := range portals {
+		reqs[i] = Request{Version: 1, Command: cmd, ID: p, ServerID: serverID}
+	}
+
+	return reqs, nil
 }
 
-func getServerInfo(ctx context.Context, c *http.Client, servURL, id string) ([]serverInfo, error) {
+// Query sends reqs to the QuickConnect control server in a single POST
+// and returns the response to each, in the same order. Errors reported
+// by the server for individual requests (ServerInfo.ErrNo) are left to
+// the caller to check.
+func (c Client) Query(ctx context.Context, reqs ...Request) ([]ServerInfo, error) {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	reqBody, err := newRequestBody("get_server_info", "dsm", id)
+	body, err := json.Marshal(reqs)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, servURL, reqBody)
+	servURL := c.servURL
+	if servURL == "" {
+		servURL = defaultServURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, servURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.Do(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := c.Client
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var info []serverInfo
+	var info []ServerInfo
 
 	err = json.NewDecoder(resp.Body).Decode(&info)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(info) != 2 {
+	if len(info) != len(reqs) {
 		return nil, ErrParse
 	}
 
-	if info[0].ErrNo != 0 {
-		return nil, fmt.Errorf("get_server_info returned errno=%d", info[0].ErrNo)
+	return info, nil
+}
+
+// getServerInfo issues cmd for the DSM portals of id, returning the
+// HTTPS and HTTP responses. If gofile is set, id is a gofile.me share
+// link ID rather than a QuickConnect ID.
+func (c Client) getServerInfo(ctx context.Context, cmd, id string, gofile bool) ([]ServerInfo, error) {
+
+	reqs, err := newRequests(cmd, "dsm", id)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range reqs {
+		reqs[i].IsGofile = gofile
+	}
+
+	info, err := c.Query(ctx, reqs...)
+	if err != nil {
+		return nil, err
 	}
 
-	if info[1].ErrNo != 0 {
-		return nil, fmt.Errorf("get_server_info returned errno=%d", info[1].ErrNo)
+	for _, i := range info {
+		if i.ErrNo != 0 {
+			return nil, fmt.Errorf("%s returned errno=%d", cmd, i.ErrNo)
+		}
 	}
 
 	return info, nil
@@ -0,0 +1,162 @@
+package qcon
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ShareLink is a parsed Synology file sharing link.
+//
+// Links on gofile.me identify the device by a share specific ID which
+// the control server looks up when queried with is_gofile set. Links on
+// quickconnect.to carry the device's QuickConnect ID.
+type ShareLink struct {
+	ID        string // gofile.me ID or QuickConnect ID
+	SharingID string
+	Gofile    bool
+}
+
+// ParseShareLink parses a sharing link of one of the forms:
+//
+//	https://gofile.me/<id>/<sharing id>
+//	https://<quickconnect id>.quickconnect.to/sharing/<sharing id>
+//	https://quickconnect.to/<quickconnect id>/sharing/<sharing id>
+//
+// The scheme may be omitted. ErrInvalidShareLink is returned for other
+// links.
+func ParseShareLink(s string) (ShareLink, error) {
+
+	var link ShareLink
+
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.User != nil {
+		return link, ErrInvalidShareLink
+	}
+
+	host := strings.ToLower(u.Hostname())
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	switch {
+	case host == "gofile.me" && len(path) == 2:
+		// gofile IDs are case sensitive so are not normalized
+		if !validShareID(path[0]) {
+			return link, ErrInvalidShareLink
+		}
+		link = ShareLink{ID: path[0], SharingID: path[1], Gofile: true}
+
+	case (host == "quickconnect.to" || host == "www.quickconnect.to") && len(path) == 3 && path[1] == "sharing":
+		link.ID, err = ParseID(path[0])
+		link.SharingID = path[2]
+
+	case strings.HasSuffix(host, ".quickconnect.to") && len(path) == 2 && path[0] == "sharing":
+		link.ID, err = ParseID(host)
+		link.SharingID = path[1]
+
+	default:
+		return link, ErrInvalidShareLink
+	}
+
+	if err != nil || !validShareID(link.SharingID) {
+		return ShareLink{}, ErrInvalidShareLink
+	}
+
+	return link, nil
+}
+
+// validShareID reports whether s is a plausible gofile or sharing ID.
+func validShareID(s string) bool {
+
+	if len(s) == 0 || len(s) > 64 {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SharedItem is an item shared through a sharing link, located on the
+// best available route to the device hosting it.
+type SharedItem struct {
+	Link   ShareLink
+	URL    string // direct download URL
+	Record Record // route URL is on
+
+	// Transport sends requests over the route, with the Host header and
+	// TLS server name set to the device's hostname where known, so the
+	// certificate of an IP address route can be verified.
+	Transport http.RoundTripper
+}
+
+// Download requests the shared item. The caller must close the body of
+// the response.
+func (s *SharedItem) Download(ctx context.Context) (*http.Response, error) {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&http.Client{Transport: s.Transport}).Do(req)
+}
+
+// sharingDownloadPath is the sharing web API request downloading the
+// item shared with a sharing ID. Parameters are JSON encoded, as by
+// the DSM web interface.
+const sharingDownloadPath = "/sharing/webapi/entry.cgi?api=SYNO.FolderSharing.Download&version=2&method=download&mode=download&stdhtml=false&_sharing_id="
+
+// ResolveShareLink locates a shared item on the best available route to
+// the device hosting it, given a sharing link in any form accepted by
+// ParseShareLink.
+//
+// ResolveShareLink is a wrapper to (Client) ResolveShareLink() using
+// DefaultClient
+func ResolveShareLink(ctx context.Context, link string) (*SharedItem, error) {
+
+	c := DefaultClient
+	return c.ResolveShareLink(ctx, link)
+}
+
+// ResolveShareLink locates a shared item on the best available route to
+// the device hosting it, given a sharing link in any form accepted by
+// ParseShareLink. The returned SharedItem gives the direct download URL
+// of the item, along with a Transport to fetch it with.
+func (c Client) ResolveShareLink(ctx context.Context, link string) (*SharedItem, error) {
+
+	l, err := ParseShareLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := c.getInfo(ctx, l.ID, l.Gofile)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.resolveDetailed(ctx, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SharedItem{
+		Link:      l,
+		URL:       res.Best.URL + sharingDownloadPath + url.QueryEscape(`"`+l.SharingID+`"`),
+		Record:    res.Best,
+		Transport: c.Transport(res.Best, &res.Info),
+	}, nil
+}
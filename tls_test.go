@@ -0,0 +1,160 @@
+package qcon
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testServerID = "030344165"
+
+// newTLSNAS starts a TLS server answering pings for testServerID. Its
+// certificate is valid for example.com and 127.0.0.1.
+func newTLSNAS() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"success": true, "ezid": "%x"}`, md5.Sum([]byte(testServerID)))
+	}))
+}
+
+// tlsClient returns a Client trusting the certificate of srv.
+func tlsClient(srv *httptest.Server) Client {
+	return Client{
+		Client: &http.Client{
+			Transport: srv.Client().Transport.(*http.Transport).Clone(),
+		},
+	}
+}
+
+func TestPinning(t *testing.T) {
+
+	srv := newTLSNAS()
+	defer srv.Close()
+
+	port := urlPort(srv.URL)
+
+	c := tlsClient(srv)
+	dir, err := ioutil.TempDir("", "qcon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c.Pins = &FilePinStore{Path: filepath.Join(dir, "pins.json")}
+
+	ctx := context.Background()
+
+	name := Record{URL: "https://127.0.0.1:" + port, ServerName: "example.com", Type: httpsFQDN}
+	ip := Record{URL: "https://127.0.0.1:" + port, Type: httpsLanIPv4}
+
+	// No pin yet so the IP route is verified normally
+	if s, _ := c.probe(ctx, testServerID, ip); s != StateOK {
+		t.Fatalf("unexpected state before pinning: %d", s)
+	}
+
+	if pin, _ := c.Pins.GetPin(testServerID); pin != nil {
+		t.Fatal("IP route should not record a pin")
+	}
+
+	// Reaching the device by name pins its key
+	if s, _ := c.probe(ctx, testServerID, name); s != StateOK {
+		t.Fatalf("unexpected state for name route: %d", s)
+	}
+
+	pin, err := c.Pins.GetPin(testServerID)
+	if err != nil || pin == nil {
+		t.Fatalf("pin not recorded: %v", err)
+	}
+
+	if s, _ := c.probe(ctx, testServerID, ip); s != StateOK {
+		t.Fatalf("unexpected state for pinned IP route: %d", s)
+	}
+
+	// A different key on an IP route is rejected, even though the
+	// certificate would otherwise be trusted
+	c.Pins.SetPin(testServerID, make([]byte, 32))
+
+	if s, _ := c.probe(ctx, testServerID, ip); s != StatePinMismatch {
+		t.Errorf("expected StatePinMismatch, got %d", s)
+	}
+
+	_, _, err = c.ping(ctx, ip, testServerID)
+
+	var pe *PinError
+	if !errors.Is(err, ErrPinMismatch) || !errors.As(err, &pe) || pe.ServerID != testServerID {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func urlPort(rawURL string) string {
+	u, _ := url.Parse(rawURL)
+	return u.Port()
+}
+
+func TestStrictTLS(t *testing.T) {
+
+	srv := newTLSNAS()
+	defer srv.Close()
+
+	port := urlPort(srv.URL)
+	ctx := context.Background()
+
+	trusting := tlsClient(srv)
+	trusting.StrictTLS = true
+
+	untrusting := Client{StrictTLS: true}
+
+	plain := Client{
+		Client: &http.Client{
+			Transport: &mockTransport{
+				responses: map[string]response{
+					"http://10.20.1.100:5000" + pingPath: {Status: 200, Body: testPingSuccess},
+				},
+			},
+		},
+		StrictTLS: true,
+	}
+
+	tests := []struct {
+		name string
+		c    Client
+		r    Record
+		exp  ConnState
+	}{
+		{"valid name", trusting, Record{URL: "https://127.0.0.1:" + port, ServerName: "example.com"}, StateOK},
+		{"wrong name", trusting, Record{URL: "https://127.0.0.1:" + port, ServerName: "nas.example.net"}, StateUntrustedTLS},
+		{"no name", trusting, Record{URL: "https://127.0.0.1:" + port}, StateUntrustedTLS},
+		{"unknown CA", untrusting, Record{URL: "https://127.0.0.1:" + port, ServerName: "example.com"}, StateUntrustedTLS},
+		{"plain HTTP", plain, Record{URL: "http://10.20.1.100:5000"}, StateUntrustedTLS},
+	}
+
+	for _, tc := range tests {
+		if s, _ := tc.c.probe(ctx, testServerID, tc.r); s != tc.exp {
+			t.Errorf("%s: expected state %d, got %d", tc.name, tc.exp, s)
+		}
+	}
+
+	// A pinned key authenticates an IP route
+	pins := &MemoryPinStore{}
+	pins.SetPin(testServerID, certPin(srv.Certificate()))
+
+	untrusting.Pins = pins
+
+	if s, _ := untrusting.probe(ctx, testServerID, Record{URL: "https://127.0.0.1:" + port, Type: httpsLanIPv4}); s != StateOK {
+		t.Errorf("pinned IP route: expected StateOK, got %d", s)
+	}
+
+	// Without strict mode the same routes are accepted
+	trusting.StrictTLS = false
+
+	if s, _ := trusting.probe(ctx, testServerID, Record{URL: "https://127.0.0.1:" + port}); s != StateOK {
+		t.Errorf("non-strict: expected StateOK, got %d", s)
+	}
+}